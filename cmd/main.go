@@ -1,13 +1,48 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
 	"github.com/Kitsuya0828/notion-google-calendar-sync/run"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
+const usage = `Usage: %s [command]
+
+Commands:
+  sync [-allow-mass-deletion]
+                    synchronize Notion and Google Calendar (default)
+  repair [-apply]   find orphans, duplicates and dangling mappings, and fix them with -apply
+  restore [uuid]    recreate a deleted event on both sides, or list the deleted events without uuid
+  conflicts [resolve <uuid> <notion|google> [field]]
+                    list the conflicts left to the user, or pick the side that wins
+  dead-letters [-all] [retry|discard <key>]
+                    list the events left out after failing repeatedly, or retry or discard one
+  history [-since d | -from t -to t] [-uuid uuid | -run id]
+                    list the recorded runs, or the operations on an event or of a run
+  undo <run-id>     revert the changes of a run, except fields edited again since
+  daemon [-interval d] [-listen addr]
+                    synchronize periodically, on POST /sync, and serve Prometheus metrics on /metrics
+                    and probes on /healthz and /readyz
+`
+
 func main() {
 	opt := &slog.HandlerOptions{
 		// AddSource: true,
@@ -16,8 +51,408 @@ func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, opt))
 	slog.SetDefault(logger)
 
-	err := run.Run()
+	command := "sync"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	shutdown, err := telemetry.SetupTracing()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	switch command {
+	case "sync":
+		err = sync(args)
+	case "repair":
+		err = repair(args)
+	case "restore":
+		err = restore(args)
+	case "conflicts":
+		err = conflicts(args)
+	case "dead-letters":
+		err = deadLetters(args)
+	case "history":
+		err = history(args)
+	case "undo":
+		err = undo(args)
+	case "daemon":
+		err = daemon(args)
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	if shutdownErr := shutdown(context.Background()); shutdownErr != nil {
+		slog.Error("flush spans", "error", shutdownErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func sync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	allowMassDeletion := fs.Bool("allow-mass-deletion", false, "proceed even if more events would be deleted than allowed")
+	format := fs.String("format", "table", "format of the report (table or json)")
+	fs.Parse(args)
+
+	report, err := run.Run(context.Background(), run.Options{AllowMassDeletion: *allowMassDeletion, Trigger: db.TriggerCLI})
+	if errors.Is(err, run.ErrAlreadyRunning) {
+		fmt.Println(err)
+		return nil
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(report); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "RUN ID\t%s\n", report.RunID)
+	fmt.Fprintf(w, "DURATION\t%s\n", report.EndedAt.Sub(report.StartedAt).Round(time.Millisecond))
+	keys := maps.Keys(report.Counts)
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%d\n", strings.ToUpper(key), report.Counts[key])
+	}
+	if len(report.Events) > 0 {
+		fmt.Fprintln(w, "\nOUTCOME\tUUID\tTITLE\tCLASS\tREASON")
+		for _, e := range report.Events {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Outcome, e.UUID, e.Title, e.Class, e.Reason)
+		}
+	}
+	if len(report.Conflicts) > 0 {
+		fmt.Fprintln(w, "\nCONFLICT\tUUID\tPOLICY\tWINNER\tNOTION\tGOOGLE CALENDAR")
+		for _, c := range report.Conflicts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%q\t%q\n", c.Field, c.UUID, c.Policy, c.Winner, c.NotionValue, c.GoogleCalendarValue)
+		}
+	}
+	if len(report.DeadLetters) > 0 {
+		fmt.Fprintln(w, "\nDEAD LETTER\tTITLE\tFAILURES\tERROR")
+		for _, d := range report.DeadLetters {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", d.Key, d.Title, d.Failures, d.Error)
+		}
+	}
+	if len(report.Steps) > 0 {
+		fmt.Fprintln(w, "\nSTEP\tSECONDS")
+		for _, step := range report.Steps {
+			fmt.Fprintf(w, "%s\t%.3f\n", step.Name, step.Seconds)
+		}
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "apply the proposed fixes")
+	fs.Parse(args)
+
+	issues, err := run.Repair(*apply)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tFIX\tUUID\tSIDE\tID\tDETAIL\tRESULT")
+	for _, issue := range issues {
+		result := "proposed"
+		if *apply {
+			result = "applied"
+			if issue.Err != nil {
+				result = issue.Err.Error()
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", issue.Kind, issue.Fix, issue.UUID, issue.Side, issue.ID, issue.Detail, result)
+	}
+	return w.Flush()
+}
+
+func restore(args []string) error {
+	if len(args) == 0 {
+		tombstones, err := run.ListTombstones()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tTITLE\tSTART\tDELETED ON\tDELETED AT\tEXPIRES AT")
+		for _, t := range tombstones {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.UUID, t.Event.Title, t.Event.StartTime.Format(time.RFC3339),
+				t.DeletedOn, t.DeletedAt.Format(time.RFC3339), t.ExpiresAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+
+	event, err := run.Restore(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %q (notion %s, google calendar %s)\n", event.Title, event.NotionEventID, event.GoogleCalendarEventID)
+	return nil
+}
+
+func conflicts(args []string) error {
+	if len(args) == 0 {
+		conflicts, err := run.ListConflicts()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tFIELD\tNOTION\tGOOGLE CALENDAR\tDETECTED AT\tWINNER")
+		for _, c := range conflicts {
+			fmt.Fprintf(w, "%s\t%s\t%q\t%q\t%s\t%s\n", c.UUID, c.Field, c.NotionValue, c.GoogleCalendarValue,
+				c.DetectedAt.Format(time.RFC3339), c.Winner)
+		}
+		return w.Flush()
+	}
+
+	if args[0] != "resolve" || len(args) < 3 {
+		return fmt.Errorf("usage: conflicts resolve <uuid> <notion|google> [field]")
+	}
+	winner := db.OriginNotion
+	if args[2] == "google" || args[2] == db.OriginGoogleCalendar {
+		winner = db.OriginGoogleCalendar
+	} else if args[2] != db.OriginNotion {
+		return fmt.Errorf("unknown side %q", args[2])
+	}
+	field := ""
+	if len(args) > 3 {
+		field = args[3]
+	}
+	resolved, err := run.ResolveConflict(args[1], winner, field)
+	if err != nil {
+		return err
+	}
+	for _, c := range resolved {
+		fmt.Printf("%s %s: %s wins on the next run\n", c.UUID, c.Field, c.Winner)
+	}
+	return nil
+}
+
+func deadLetters(args []string) error {
+	fs := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	all := fs.Bool("all", false, "also list the discarded events")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) == 0 {
+		deadLetters, err := run.ListDeadLetters(*all)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tTITLE\tFAILURES\tFIRST FAILED AT\tLAST FAILED AT\tCLASS\tERROR\tDISCARDED")
+		for _, d := range deadLetters {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%t\n", d.Key, d.Title, d.Failures,
+				d.FirstFailedAt.Format(time.RFC3339), d.LastFailedAt.Format(time.RFC3339), d.Class, d.Error, d.Discarded)
+		}
+		return w.Flush()
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("usage: dead-letters [-all] [retry|discard <key>]")
+	}
+	switch args[0] {
+	case "retry":
+		d, err := run.RetryDeadLetter(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %q: retried by the next run\n", d.Key, d.Title)
+	case "discard":
+		d, err := run.DiscardDeadLetter(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %q: left out until it is retried\n", d.Key, d.Title)
+	default:
+		return fmt.Errorf("unknown action %q", args[0])
+	}
+	return nil
+}
+
+func history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.Duration("since", 24*time.Hour, "list the entries of this period until now")
+	from := fs.String("from", "", "start of the period (RFC 3339), overrides -since")
+	to := fs.String("to", "", "end of the period (RFC 3339)")
+	uuid := fs.String("uuid", "", "list the operations on an event")
+	runID := fs.String("run", "", "list the operations of a run")
+	fs.Parse(args)
+
+	q := run.HistoryQuery{From: time.Now().Add(-*since), To: time.Now(), UUID: *uuid, RunID: *runID}
+	var err error
+	if *from != "" {
+		if q.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("parse -from: %w", err)
+		}
+	}
+	if *to != "" {
+		if q.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("parse -to: %w", err)
+		}
+	}
+
+	records, operations, err := run.History(q)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(records) > 0 {
+		fmt.Fprintln(w, "RUN ID\tCOMMAND\tTRIGGER\tSTARTED AT\tENDED AT\tOPERATIONS\tERROR")
+		for _, r := range records {
+			ended := ""
+			if !r.EndedAt.IsZero() {
+				ended = r.EndedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.ID, r.Command, r.Trigger, r.StartedAt.Format(time.RFC3339), ended, r.Operations, r.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(operations) > 0 {
+		fmt.Fprintln(w, "AT\tRUN ID\tUUID\tSIDE\tACTION\tCHANGES\tERROR")
+		for _, o := range operations {
+			changes := []string{}
+			for _, c := range o.Changes {
+				changes = append(changes, fmt.Sprintf("%s: %q -> %q", c.Field, c.Before, c.After))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", o.At.Format(time.RFC3339), o.RunID, o.UUID, o.Side, o.Action, strings.Join(changes, "; "), o.Error)
+		}
+	}
+	return w.Flush()
+}
+
+func undo(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: undo <run-id>")
+	}
+	reversals, err := run.Undo(args[0])
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UUID\tSIDE\tACTION\tRESULT")
+	for _, r := range reversals {
+		result := "reverted"
+		switch {
+		case r.Err != nil:
+			result = r.Err.Error()
+		case r.Skipped != "":
+			result = "skipped: " + r.Skipped
+		case len(r.Reverted) > 0:
+			result = "reverted " + strings.Join(r.Reverted, ", ")
+			if len(r.Kept) > 0 {
+				result += ", kept " + strings.Join(r.Kept, ", ")
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Operation.UUID, r.Operation.Side, r.Operation.Action, result)
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func daemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	interval := fs.Duration("interval", 30*time.Minute, "interval between synchronizations")
+	listen := fs.String("listen", ":9090", "address to serve the metrics and the probes on")
+	fs.Parse(args)
+
+	handler, shutdown, err := telemetry.SetupMetrics()
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Runs triggered by the ticker and by requests never overlap, and a run is not queued behind another
+	lock := make(chan struct{}, 1)
+	runOnce := func(ctx context.Context, trigger string) (*run.Report, error) {
+		select {
+		case lock <- struct{}{}:
+		default:
+			return nil, run.ErrAlreadyRunning
+		}
+		defer func() { <-lock }()
+		return run.Run(ctx, run.Options{Trigger: trigger})
+	}
+
+	health, err := run.NewHealth(ctx)
+	if err != nil {
+		return err
+	}
+	defer health.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.Live(r.Context()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.Ready(r.Context()))
+	})
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Continue the trace of the request
+		ctx := telemetry.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		report, err := runOnce(ctx, db.TriggerWebhook)
+		if report == nil { // Another run of this process is in progress
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case errors.Is(err, run.ErrAlreadyRunning):
+			w.WriteHeader(http.StatusConflict)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	server := &http.Server{Addr: *listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serve http", "error", err)
+		}
+	}()
+	defer server.Shutdown(context.Background())
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		// A failed run is retried at the next tick
+		_, err := runOnce(ctx, db.TriggerScheduler)
+		switch {
+		case errors.Is(err, run.ErrAlreadyRunning):
+			slog.Info("skip run", "reason", err)
+		case err != nil:
+			slog.Error("run", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeHealth responds with the status of a probe, failing if a check failed
+func writeHealth(w http.ResponseWriter, status *run.HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !status.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
 }
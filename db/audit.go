@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	runCollectionID       = "runs"
+	operationCollectionID = "operations"
+
+	// Triggers of a run
+	TriggerScheduler = "scheduler"
+	TriggerWebhook   = "webhook"
+	TriggerCLI       = "cli"
+
+	// SideDB is the side of the operations on the database
+	SideDB = "db"
+
+	// Actions of an operation
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+)
+
+// RunRecord records a run in the audit log
+type RunRecord struct {
+	ID         string    `firestore:"id"`
+	Command    string    `firestore:"command"` // sync, repair or restore
+	Trigger    string    `firestore:"trigger"`
+	StartedAt  time.Time `firestore:"started_at"`
+	EndedAt    time.Time `firestore:"ended_at"` // Zero while the run is in progress
+	Operations int       `firestore:"operations"`
+	Error      string    `firestore:"error"`
+	ExpiresAt  time.Time `firestore:"expires_at"` // Purged with its operations after this time
+}
+
+// Operation records a change made by a run on one side, with the state of the event before and after it
+type Operation struct {
+	RunID     string    `firestore:"run_id"`
+	UUID      string    `firestore:"uuid"`
+	Side      string    `firestore:"side"` // OriginNotion, OriginGoogleCalendar or SideDB
+	Action    string    `firestore:"action"`
+	Before    *Event    `firestore:"before"` // Nil for a creation
+	After     *Event    `firestore:"after"`  // Nil for a deletion
+	Changes   []Change  `firestore:"changes"`
+	Error     string    `firestore:"error"`
+	At        time.Time `firestore:"at"`
+	ExpiresAt time.Time `firestore:"expires_at"` // Same as its run
+}
+
+// Change is the difference of a field made by an operation
+type Change struct {
+	Field  string `firestore:"field"`
+	Before string `firestore:"before"`
+	After  string `firestore:"after"`
+}
+
+func (ds *DatabaseService) SetRunRecord(ctx context.Context, record *RunRecord) error {
+	_, err := ds.client.Collection(runCollectionID).Doc(record.ID).Set(ctx, record)
+	if err != nil {
+		return fmt.Errorf("overwrite a run record: %w", err)
+	}
+	slog.Debug("set a run record on db", "run_id", record.ID)
+	return nil
+}
+
+func (ds *DatabaseService) GetRunRecord(ctx context.Context, id string) (*RunRecord, error) {
+	doc, err := ds.client.Collection(runCollectionID).Doc(id).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get a run record: %w", err)
+	}
+	var record RunRecord
+	err = doc.DataTo(&record)
+	if err != nil {
+		return nil, fmt.Errorf("convert from document to run record type: %w", err)
+	}
+	return &record, nil
+}
+
+// ListRunRecords returns the runs started in [from, to), oldest first
+func (ds *DatabaseService) ListRunRecords(ctx context.Context, from time.Time, to time.Time) ([]*RunRecord, error) {
+	iter := ds.client.Collection(runCollectionID).
+		Where("started_at", ">=", from).
+		Where("started_at", "<", to).
+		OrderBy("started_at", firestore.Asc).
+		Documents(ctx)
+	records := []*RunRecord{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate run record: %w", err)
+		}
+
+		var record RunRecord
+		err = doc.DataTo(&record)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to run record type: %w", err)
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+func (ds *DatabaseService) AddOperation(ctx context.Context, operation *Operation) error {
+	_, _, err := ds.client.Collection(operationCollectionID).Add(ctx, operation)
+	if err != nil {
+		return fmt.Errorf("add an operation: %w", err)
+	}
+	return nil
+}
+
+// ListOperations returns the operations whose field equals value (e.g. "run_id" or "uuid"), oldest first
+func (ds *DatabaseService) ListOperations(ctx context.Context, field string, value string) ([]*Operation, error) {
+	iter := ds.client.Collection(operationCollectionID).Where(field, "==", value).Documents(ctx)
+	operations := []*Operation{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate operation: %w", err)
+		}
+
+		var operation Operation
+		err = doc.DataTo(&operation)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to operation type: %w", err)
+		}
+		operations = append(operations, &operation)
+	}
+	// Sorted here to avoid a composite index
+	slices.SortStableFunc(operations, func(a, b *Operation) int { return a.At.Compare(b.At) })
+	return operations, nil
+}
+
+// PurgeAudit deletes the runs and operations that expired before now
+func (ds *DatabaseService) PurgeAudit(ctx context.Context, now time.Time) error {
+	// Operations first, so that a failed purge does not leave operations of a purged run
+	num, err := ds.purgeExpired(ctx, operationCollectionID, now)
+	if err != nil {
+		return fmt.Errorf("purge expired operations: %w", err)
+	}
+	slog.Info("purged expired operations", "num", num)
+	num, err = ds.purgeExpired(ctx, runCollectionID, now)
+	if err != nil {
+		return fmt.Errorf("purge expired run records: %w", err)
+	}
+	slog.Info("purged expired run records", "num", num)
+	return nil
+}
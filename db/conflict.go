@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	conflictCollectionID = "conflicts"
+	// Conflicts left to the user are queued until they are resolved
+	conflictQueueCollectionID = "conflict_queue"
+)
+
+// Conflict records a field changed differently on Notion and Google Calendar, and how it was resolved
+type Conflict struct {
+	UUID                string    `firestore:"uuid"`
+	Field               string    `firestore:"field"`
+	Policy              string    `firestore:"policy"`
+	Winner              string    `firestore:"winner"` // OriginNotion, OriginGoogleCalendar, or empty if not resolved yet
+	NotionValue         string    `firestore:"notion_value"`
+	GoogleCalendarValue string    `firestore:"google_calendar_value"`
+	DetectedAt          time.Time `firestore:"detected_at"`
+}
+
+func (ds *DatabaseService) AddConflict(ctx context.Context, conflict *Conflict) error {
+	_, _, err := ds.client.Collection(conflictCollectionID).Add(ctx, conflict)
+	if err != nil {
+		return fmt.Errorf("add a conflict: %w", err)
+	}
+	slog.Debug("add a conflict on db", "uuid", conflict.UUID, "field", conflict.Field)
+	return nil
+}
+
+// queuedConflictID returns the document ID of a queued conflict, escaped since property names may contain slashes
+func queuedConflictID(uuid string, field string) string {
+	return uuid + "_" + url.PathEscape(field)
+}
+
+func (ds *DatabaseService) SetQueuedConflict(ctx context.Context, conflict *Conflict) error {
+	_, err := ds.client.Collection(conflictQueueCollectionID).Doc(queuedConflictID(conflict.UUID, conflict.Field)).Set(ctx, conflict)
+	if err != nil {
+		return fmt.Errorf("overwrite a queued conflict: %w", err)
+	}
+	slog.Debug("set a queued conflict on db", "uuid", conflict.UUID, "field", conflict.Field)
+	return nil
+}
+
+func (ds *DatabaseService) DeleteQueuedConflict(ctx context.Context, conflict *Conflict) error {
+	_, err := ds.client.Collection(conflictQueueCollectionID).Doc(queuedConflictID(conflict.UUID, conflict.Field)).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("delete a queued conflict: %w", err)
+	}
+	slog.Debug("delete a queued conflict on db", "uuid", conflict.UUID, "field", conflict.Field)
+	return nil
+}
+
+func (ds *DatabaseService) ListQueuedConflicts(ctx context.Context) ([]*Conflict, error) {
+	iter := ds.client.Collection(conflictQueueCollectionID).OrderBy("detected_at", firestore.Asc).Documents(ctx)
+	conflicts := []*Conflict{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate queued conflict: %w", err)
+		}
+
+		var conflict Conflict
+		err = doc.DataTo(&conflict)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to conflict type: %w", err)
+		}
+		conflicts = append(conflicts, &conflict)
+	}
+	return conflicts, nil
+}
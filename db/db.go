@@ -2,13 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
 	"github.com/caarlos0/env/v9"
 	"golang.org/x/exp/slog"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -20,48 +24,126 @@ type Config struct {
 }
 
 type DatabaseService struct {
-	client *firestore.Client
+	client   *firestore.Client
+	location *time.Location // Time zone in which older versions stored all-day events
 }
 
-func CreateService(ctx context.Context) (*DatabaseService, error) {
+// CreateService connects to Firestore. loc is the time zone in which older versions stored all-day events.
+func CreateService(ctx context.Context, loc *time.Location) (*DatabaseService, error) {
 	cfg := Config{}
 	if err := env.Parse(&cfg); err != nil {
-		return nil, fmt.Errorf("parse env: %v", err)
+		return nil, fmt.Errorf("parse env: %w", err)
 	}
 	c, err := firestore.NewClient(ctx, cfg.ProjectID)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		return nil, fmt.Errorf("create client: %w", err)
 	}
 	ds := &DatabaseService{
-		client: c,
+		client:   c,
+		location: loc,
 	}
 	return ds, nil
 }
 
+// changedError is the type of ErrEventChanged
+type changedError struct{}
+
+func (changedError) Error() string {
+	return "event changed since it was read"
+}
+
+// ErrorClass makes ErrEventChanged transient, since the event is read again by the next run
+func (changedError) ErrorClass() string {
+	return retry.ClassTransient
+}
+
+var (
+	// ErrEventChanged is returned when an event has been written or deleted by another writer since it was read
+	ErrEventChanged error = changedError{}
+	// ErrEventExists is returned when an event to add is already recorded
+	ErrEventExists = errors.New("event already recorded")
+	// ErrEventNotFound is returned when an event is not recorded
+	ErrEventNotFound = errors.New("event not recorded")
+)
+
+// AddEvent records a new event with its first version
 func (ds *DatabaseService) AddEvent(ctx context.Context, event *Event) error {
 	uuid := event.UUID
 
-	_, err := ds.client.Collection(collectionID).Doc(uuid).Create(ctx, event)
+	added := *event
+	added.Version = 1
+	_, err := ds.client.Collection(collectionID).Doc(uuid).Create(ctx, &added)
+	if status.Code(err) == codes.AlreadyExists {
+		return fmt.Errorf("create a document: %w", ErrEventExists)
+	}
 	if err != nil {
-		return fmt.Errorf("create a document: %v", err)
+		return fmt.Errorf("create a document: %w", err)
 	}
+	event.Version = added.Version
 	slog.Info("added an event to db", "uuid", event.UUID)
 	return nil
 }
 
+func (ds *DatabaseService) GetEvent(ctx context.Context, uuid string) (*Event, error) {
+	doc, err := ds.client.Collection(collectionID).Doc(uuid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("get a document: %w", ErrEventNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get a document: %w", err)
+	}
+	return ds.toEvent(doc)
+}
+
+// checkVersion fails with ErrEventChanged unless the recorded version of an event, zero if it is not recorded, is version
+func (ds *DatabaseService) checkVersion(tx *firestore.Transaction, uuid string, version int64) error {
+	doc, err := tx.Get(ds.client.Collection(collectionID).Doc(uuid))
+	current := int64(0)
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return err
+	default:
+		stored, err := ds.toEvent(doc)
+		if err != nil {
+			return err
+		}
+		current = stored.Version
+	}
+	if current != version {
+		return fmt.Errorf("%w: version %d recorded, %d read", ErrEventChanged, current, version)
+	}
+	return nil
+}
+
+// SetEvent overwrites an event if its recorded version is still the version of event, and increments it
 func (ds *DatabaseService) SetEvent(ctx context.Context, event *Event) error {
-	_, err := ds.client.Collection(collectionID).Doc(event.UUID).Set(ctx, event)
+	updated := *event
+	updated.Version++
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := ds.checkVersion(tx, event.UUID, event.Version); err != nil {
+			return err
+		}
+		return tx.Set(ds.client.Collection(collectionID).Doc(event.UUID), &updated)
+	})
 	if err != nil {
-		return fmt.Errorf("overwrite a document: %v", err)
+		return fmt.Errorf("overwrite a document: %w", err)
 	}
+	event.Version = updated.Version
 	slog.Info("set an event on db", "uuid", event.UUID)
 	return nil
 }
 
+// DeleteEvent deletes an event if its recorded version is still the version of event
 func (ds *DatabaseService) DeleteEvent(ctx context.Context, event *Event) error {
-	_, err := ds.client.Collection(collectionID).Doc(event.UUID).Delete(ctx)
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := ds.checkVersion(tx, event.UUID, event.Version); err != nil {
+			return err
+		}
+		return tx.Delete(ds.client.Collection(collectionID).Doc(event.UUID))
+	})
 	if err != nil {
-		return fmt.Errorf("delete a document: %v", err)
+		return fmt.Errorf("delete a document: %w", err)
 	}
 	slog.Info("delete an event on db", "uuid", event.UUID)
 	return nil
@@ -76,20 +158,46 @@ func (ds *DatabaseService) ListEvents(ctx context.Context) ([]*Event, error) {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("iterate document: %v", err)
+			return nil, fmt.Errorf("iterate document: %w", err)
 		}
 
-		var event Event
-		err = doc.DataTo(&event)
+		event, err := ds.toEvent(doc)
 		if err != nil {
-			return nil, fmt.Errorf("convert from document to event type: %v", err)
+			return nil, err
 		}
-		events = append(events, &event)
+		events = append(events, event)
 	}
 	slog.Info("listed db events", "num", len(events))
 	return events, nil
 }
 
+// toEvent converts a document to an event, upgrading the fields stored by older versions
+func (ds *DatabaseService) toEvent(doc *firestore.DocumentSnapshot) (*Event, error) {
+	var event Event
+	err := doc.DataTo(&event)
+	if err != nil {
+		return nil, fmt.Errorf("convert from document to event type: %w", err)
+	}
+	if colorID, ok := ColorMap[event.Color]; ok { // Stored as a Notion color by older versions
+		event.Color = colorID
+	}
+	if event.IsAllday {
+		event.StartTime = allDayDate(event.StartTime, ds.location)
+		event.EndTime = allDayDate(event.EndTime, ds.location)
+	}
+	return &event, nil
+}
+
+// allDayDate returns the date of an all-day event at midnight UTC. Older versions stored it at midnight in loc.
+func allDayDate(t time.Time, loc *time.Location) time.Time {
+	t = t.UTC()
+	if t.Truncate(24 * time.Hour).Equal(t) { // Already at midnight UTC
+		return t
+	}
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
 func (ds *DatabaseService) Close() error {
 	return ds.client.Close()
 }
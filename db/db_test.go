@@ -0,0 +1,44 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+)
+
+func TestAllDayDate(t *testing.T) {
+	want := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"UTC", "Asia/Tokyo", "Pacific/Kiritimati", "Pacific/Tongatapu", "America/Los_Angeles", "Pacific/Pago_Pago"} {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatalf("load location %s: %v", name, err)
+		}
+		// Stored by older versions
+		if got := allDayDate(time.Date(2023, 10, 1, 0, 0, 0, 0, loc), loc); !got.Equal(want) {
+			t.Errorf("allDayDate(local midnight in %s) = %v, want %v", name, got, want)
+		}
+		// Stored by this version
+		if got := allDayDate(want, loc); !got.Equal(want) {
+			t.Errorf("allDayDate(midnight UTC) with %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("update a document: %w", ErrEventChanged), retry.ClassTransient},
+		{fmt.Errorf("list events: %w", &ValidationError{Side: OriginNotion, ID: "id", Err: errors.New("no date")}), retry.ClassValidation},
+		{fmt.Errorf("get a document: %w", ErrEventNotFound), retry.ClassPermanent},
+	}
+	for _, tt := range tests {
+		if got := retry.Class(tt.err); got != tt.want {
+			t.Errorf("retry.Class(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// Events failing in consecutive runs are counted until they succeed or are moved to the dead letters
+	failedEventCollectionID = "failed_events"
+	deadLetterCollectionID  = "dead_letters"
+)
+
+// FailedEvent records the consecutive failures of an event
+type FailedEvent struct {
+	Key           string    `firestore:"key"` // UUID of the event, or its side and ID if it has none
+	UUID          string    `firestore:"uuid"`
+	Side          string    `firestore:"side"` // OriginNotion or OriginGoogleCalendar if the event has no UUID
+	ID            string    `firestore:"id"`   // ID of the event on its side if it has no UUID
+	Title         string    `firestore:"title"`
+	Failures      int       `firestore:"failures"`
+	Error         string    `firestore:"error"` // Last error
+	Class         string    `firestore:"class"`
+	FirstFailedAt time.Time `firestore:"first_failed_at"`
+	LastFailedAt  time.Time `firestore:"last_failed_at"`
+	Discarded     bool      `firestore:"discarded"` // Whether a dead letter is left out for good
+}
+
+func (ds *DatabaseService) SetFailedEvent(ctx context.Context, failed *FailedEvent) error {
+	_, err := ds.client.Collection(failedEventCollectionID).Doc(failed.Key).Set(ctx, failed)
+	if err != nil {
+		return fmt.Errorf("overwrite a failed event: %w", err)
+	}
+	slog.Debug("set a failed event on db", "key", failed.Key, "failures", failed.Failures)
+	return nil
+}
+
+func (ds *DatabaseService) DeleteFailedEvent(ctx context.Context, key string) error {
+	_, err := ds.client.Collection(failedEventCollectionID).Doc(key).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("delete a failed event: %w", err)
+	}
+	slog.Debug("delete a failed event on db", "key", key)
+	return nil
+}
+
+func (ds *DatabaseService) ListFailedEvents(ctx context.Context) ([]*FailedEvent, error) {
+	return ds.listFailedEvents(ctx, failedEventCollectionID)
+}
+
+// KillFailedEvent moves a failed event to the dead letters
+func (ds *DatabaseService) KillFailedEvent(ctx context.Context, failed *FailedEvent) error {
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Set(ds.client.Collection(deadLetterCollectionID).Doc(failed.Key), failed); err != nil {
+			return err
+		}
+		return tx.Delete(ds.client.Collection(failedEventCollectionID).Doc(failed.Key))
+	})
+	if err != nil {
+		return fmt.Errorf("move a failed event to the dead letters: %w", err)
+	}
+	slog.Warn("moved an event to the dead letters", "key", failed.Key, "failures", failed.Failures, "error", failed.Error)
+	return nil
+}
+
+func (ds *DatabaseService) GetDeadLetter(ctx context.Context, key string) (*FailedEvent, error) {
+	doc, err := ds.client.Collection(deadLetterCollectionID).Doc(key).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get a dead letter: %w", err)
+	}
+	var failed FailedEvent
+	err = doc.DataTo(&failed)
+	if err != nil {
+		return nil, fmt.Errorf("convert from document to failed event type: %w", err)
+	}
+	return &failed, nil
+}
+
+func (ds *DatabaseService) SetDeadLetter(ctx context.Context, failed *FailedEvent) error {
+	_, err := ds.client.Collection(deadLetterCollectionID).Doc(failed.Key).Set(ctx, failed)
+	if err != nil {
+		return fmt.Errorf("overwrite a dead letter: %w", err)
+	}
+	slog.Debug("set a dead letter on db", "key", failed.Key)
+	return nil
+}
+
+func (ds *DatabaseService) DeleteDeadLetter(ctx context.Context, key string) error {
+	_, err := ds.client.Collection(deadLetterCollectionID).Doc(key).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("delete a dead letter: %w", err)
+	}
+	slog.Info("delete a dead letter on db", "key", key)
+	return nil
+}
+
+// ListDeadLetters returns the events moved to the dead letters, the oldest failure first
+func (ds *DatabaseService) ListDeadLetters(ctx context.Context) ([]*FailedEvent, error) {
+	return ds.listFailedEvents(ctx, deadLetterCollectionID)
+}
+
+func (ds *DatabaseService) listFailedEvents(ctx context.Context, collection string) ([]*FailedEvent, error) {
+	iter := ds.client.Collection(collection).OrderBy("first_failed_at", firestore.Asc).Documents(ctx)
+	events := []*FailedEvent{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate %s: %w", collection, err)
+		}
+
+		var failed FailedEvent
+		err = doc.DataTo(&failed)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to failed event type: %w", err)
+		}
+		events = append(events, &failed)
+	}
+	return events, nil
+}
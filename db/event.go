@@ -1,8 +1,12 @@
 package db
 
-import "time"
+import (
+	"time"
 
-// ColorMap is a map to convert from [Notion] colors to [Google Calendar] colors
+	"golang.org/x/exp/slog"
+)
+
+// ColorMap is the default map to convert from [Notion] option colors to [Google Calendar] color IDs
 //
 // [Notion]: https://developers.notion.com/reference/property-object#multi-select
 // [Google Calendar]: https://developers.google.com/calendar/api/v3/reference/colors/get?hl=ja
@@ -21,15 +25,33 @@ var ColorMap = map[string]string{
 
 // Event represents an event to be stored in the database
 type Event struct {
-	UUID                  string    `firestore:"uuid"`
-	Title                 string    `firestore:"title"`
-	StartTime             time.Time `firestore:"start_time"`
-	EndTime               time.Time `firestore:"end_time"`
-	CreatedTime           time.Time `firestore:"created_time"`
-	UpdatedTime           time.Time `firestore:"updated_time"`
-	Color                 string    `firestore:"color"`
-	IsAllday              bool      `firestore:"is_all_day"`
-	NotionEventID         string    `firestore:"notion_event_id"`
-	GoogleCalendarEventID string    `firestore:"google_calendar_event_id"`
-	Description           string    `firestore:"description"`
+	UUID                  string            `firestore:"uuid"`
+	Title                 string            `firestore:"title"`
+	StartTime             time.Time         `firestore:"start_time"`
+	EndTime               time.Time         `firestore:"end_time"`
+	CreatedTime           time.Time         `firestore:"created_time"`
+	UpdatedTime           time.Time         `firestore:"updated_time"`
+	Color                 string            `firestore:"color"` // Google Calendar color ID
+	IsAllday              bool              `firestore:"is_all_day"`
+	TimeZone              string            `firestore:"time_zone"` // IANA time zone of a timed event, empty if unspecified
+	NotionEventID         string            `firestore:"notion_event_id"`
+	GoogleCalendarEventID string            `firestore:"google_calendar_event_id"`
+	Description           string            `firestore:"description"`
+	Tags                  []string          `firestore:"tags"`
+	Properties            map[string]string `firestore:"properties"` // Notion select and status values by property name
+	ConflictFlagged       bool              `firestore:"-"`          // Whether the Notion page is flagged with an unresolved conflict
+	Version               int64             `firestore:"version"`    // Incremented by each write to the database, zero if not recorded
+}
+
+// Location returns the time zone of the event, or fallback if it does not specify one
+func (e *Event) Location(fallback *time.Location) *time.Location {
+	if e.TimeZone == "" {
+		return fallback
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		slog.Warn("unknown time zone", "uuid", e.UUID, "time_zone", e.TimeZone)
+		return fallback
+	}
+	return loc
 }
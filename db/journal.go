@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	journalCollectionID = "journal"
+
+	// OriginNotion and OriginGoogleCalendar tell on which side an event was first created
+	OriginNotion         = "notion"
+	OriginGoogleCalendar = "google_calendar"
+)
+
+// JournalEntry records the creation of an event on the other side before it starts,
+// so that a run interrupted between the steps can be finished or rolled back by the next run.
+// Event is updated after each step with the IDs created so far.
+type JournalEntry struct {
+	UUID      string    `firestore:"uuid"`
+	Origin    string    `firestore:"origin"`
+	Event     *Event    `firestore:"event"`
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+// SourceID returns the ID of the event on the side it was first created
+func (je *JournalEntry) SourceID() string {
+	if je.Origin == OriginNotion {
+		return je.Event.NotionEventID
+	}
+	return je.Event.GoogleCalendarEventID
+}
+
+func (ds *DatabaseService) SetJournalEntry(ctx context.Context, entry *JournalEntry) error {
+	_, err := ds.client.Collection(journalCollectionID).Doc(entry.UUID).Set(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("overwrite a journal entry: %w", err)
+	}
+	slog.Debug("set a journal entry on db", "uuid", entry.UUID)
+	return nil
+}
+
+func (ds *DatabaseService) DeleteJournalEntry(ctx context.Context, entry *JournalEntry) error {
+	_, err := ds.client.Collection(journalCollectionID).Doc(entry.UUID).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("delete a journal entry: %w", err)
+	}
+	slog.Debug("delete a journal entry on db", "uuid", entry.UUID)
+	return nil
+}
+
+func (ds *DatabaseService) ListJournalEntries(ctx context.Context) ([]*JournalEntry, error) {
+	iter := ds.client.Collection(journalCollectionID).Documents(ctx)
+	entries := []*JournalEntry{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate journal entry: %w", err)
+		}
+
+		var entry JournalEntry
+		err = doc.DataTo(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to journal entry type: %w", err)
+		}
+		entries = append(entries, &entry)
+	}
+	slog.Info("listed journal entries", "num", len(entries))
+	return entries, nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	leaseCollectionID = "leases"
+)
+
+var (
+	// ErrLeaseHeld is returned when another holder has a lease that has not expired
+	ErrLeaseHeld = errors.New("lease held by another holder")
+	// ErrLeaseLost is returned when a lease has been released or taken by another holder after it expired
+	ErrLeaseLost = errors.New("lease lost")
+)
+
+// Lease grants exclusive access to a resource to a holder until it expires
+type Lease struct {
+	Name       string    `firestore:"name"`
+	Holder     string    `firestore:"holder"`
+	AcquiredAt time.Time `firestore:"acquired_at"`
+	ExpiresAt  time.Time `firestore:"expires_at"`
+}
+
+// getLease returns the lease of a name in a transaction, or nil if there is none
+func (ds *DatabaseService) getLease(tx *firestore.Transaction, name string) (*Lease, error) {
+	doc, err := tx.Get(ds.client.Collection(leaseCollectionID).Doc(name))
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lease Lease
+	if err := doc.DataTo(&lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// AcquireLease gives the lease of a name to holder for ttl, unless another holder has it
+func (ds *DatabaseService) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) error {
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		lease, err := ds.getLease(tx, name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if lease != nil && lease.Holder != holder && lease.ExpiresAt.After(now) {
+			return fmt.Errorf("%w: %s until %s", ErrLeaseHeld, lease.Holder, lease.ExpiresAt.Format(time.RFC3339))
+		}
+		return tx.Set(ds.client.Collection(leaseCollectionID).Doc(name), &Lease{
+			Name:       name,
+			Holder:     holder,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("acquire a lease: %w", err)
+	}
+	slog.Debug("acquire a lease on db", "name", name, "holder", holder)
+	return nil
+}
+
+// RenewLease extends the lease of a name held by holder by ttl from now
+func (ds *DatabaseService) RenewLease(ctx context.Context, name string, holder string, ttl time.Duration) error {
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		lease, err := ds.getLease(tx, name)
+		if err != nil {
+			return err
+		}
+		if lease == nil || lease.Holder != holder {
+			return ErrLeaseLost
+		}
+		lease.ExpiresAt = time.Now().Add(ttl)
+		return tx.Set(ds.client.Collection(leaseCollectionID).Doc(name), lease)
+	})
+	if err != nil {
+		return fmt.Errorf("renew a lease: %w", err)
+	}
+	slog.Debug("renew a lease on db", "name", name, "holder", holder)
+	return nil
+}
+
+// ReleaseLease gives up the lease of a name if holder still has it
+func (ds *DatabaseService) ReleaseLease(ctx context.Context, name string, holder string) error {
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		lease, err := ds.getLease(tx, name)
+		if err != nil {
+			return err
+		}
+		if lease == nil || lease.Holder != holder {
+			return nil
+		}
+		return tx.Delete(ds.client.Collection(leaseCollectionID).Doc(name))
+	})
+	if err != nil {
+		return fmt.Errorf("release a lease: %w", err)
+	}
+	slog.Debug("release a lease on db", "name", name, "holder", holder)
+	return nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	notificationCollectionID = "notifications"
+)
+
+// NotificationState records when a kind of notification was last sent, shared by the instances of the function
+type NotificationState struct {
+	Kind       string    `firestore:"kind"`
+	LastSentAt time.Time `firestore:"last_sent_at"`
+	Suppressed int       `firestore:"suppressed"` // Notifications not sent since then
+}
+
+// ThrottleNotification reports whether a notification of a kind may be sent at now, which it may if none was sent
+// in the last period, and how many were suppressed since the last one. A suppressed notification is counted.
+func (ds *DatabaseService) ThrottleNotification(ctx context.Context, kind string, now time.Time, period time.Duration) (bool, int, error) {
+	send := false
+	suppressed := 0
+	ref := ds.client.Collection(notificationCollectionID).Doc(kind)
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		state := &NotificationState{Kind: kind}
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := doc.DataTo(state); err != nil {
+				return err
+			}
+		}
+		send = now.Sub(state.LastSentAt) >= period
+		suppressed = state.Suppressed
+		if send {
+			state.LastSentAt = now
+			state.Suppressed = 0
+		} else {
+			state.Suppressed++
+		}
+		return tx.Set(ref, state)
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("throttle a notification: %w", err)
+	}
+	slog.Debug("throttle a notification on db", "kind", kind, "send", send, "suppressed", suppressed)
+	return send, suppressed, nil
+}
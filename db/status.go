@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	statusCollectionID = "status"
+	lastSuccessDocID   = "last_success"
+)
+
+// SyncStatus records the last successful sync, shared by the instances
+type SyncStatus struct {
+	RunID   string    `firestore:"run_id"`
+	EndedAt time.Time `firestore:"ended_at"`
+}
+
+func (ds *DatabaseService) SetLastSuccess(ctx context.Context, s *SyncStatus) error {
+	_, err := ds.client.Collection(statusCollectionID).Doc(lastSuccessDocID).Set(ctx, s)
+	if err != nil {
+		return fmt.Errorf("overwrite the last success: %w", err)
+	}
+	slog.Debug("set the last success on db", "run_id", s.RunID)
+	return nil
+}
+
+// GetLastSuccess returns the last successful sync, which has a zero time if there has been none
+func (ds *DatabaseService) GetLastSuccess(ctx context.Context) (*SyncStatus, error) {
+	doc, err := ds.client.Collection(statusCollectionID).Doc(lastSuccessDocID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return &SyncStatus{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get the last success: %w", err)
+	}
+	var s SyncStatus
+	err = doc.DataTo(&s)
+	if err != nil {
+		return nil, fmt.Errorf("convert from document to sync status type: %w", err)
+	}
+	return &s, nil
+}
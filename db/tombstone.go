@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	tombstoneCollectionID = "tombstones"
+)
+
+// Tombstone keeps the last known state of a deleted event until it expires, so that the event can be restored
+type Tombstone struct {
+	UUID      string    `firestore:"uuid"`
+	Event     *Event    `firestore:"event"`
+	DeletedOn string    `firestore:"deleted_on"` // OriginNotion or OriginGoogleCalendar
+	DeletedAt time.Time `firestore:"deleted_at"`
+	ExpiresAt time.Time `firestore:"expires_at"`
+}
+
+// BuryEvent replaces the mapping of a deleted event with a tombstone, if the recorded version is still the version of the event
+func (ds *DatabaseService) BuryEvent(ctx context.Context, tombstone *Tombstone) error {
+	err := ds.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := ds.checkVersion(tx, tombstone.UUID, tombstone.Event.Version); err != nil {
+			return err
+		}
+		if err := tx.Set(ds.client.Collection(tombstoneCollectionID).Doc(tombstone.UUID), tombstone); err != nil {
+			return err
+		}
+		return tx.Delete(ds.client.Collection(collectionID).Doc(tombstone.UUID))
+	})
+	if err != nil {
+		return fmt.Errorf("replace a document with a tombstone: %w", err)
+	}
+	slog.Info("buried an event on db", "uuid", tombstone.UUID, "deleted_on", tombstone.DeletedOn)
+	return nil
+}
+
+func (ds *DatabaseService) GetTombstone(ctx context.Context, uuid string) (*Tombstone, error) {
+	doc, err := ds.client.Collection(tombstoneCollectionID).Doc(uuid).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get a tombstone: %w", err)
+	}
+	var tombstone Tombstone
+	err = doc.DataTo(&tombstone)
+	if err != nil {
+		return nil, fmt.Errorf("convert from document to tombstone type: %w", err)
+	}
+	return &tombstone, nil
+}
+
+func (ds *DatabaseService) DeleteTombstone(ctx context.Context, uuid string) error {
+	_, err := ds.client.Collection(tombstoneCollectionID).Doc(uuid).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("delete a tombstone: %w", err)
+	}
+	slog.Info("delete a tombstone on db", "uuid", uuid)
+	return nil
+}
+
+func (ds *DatabaseService) ListTombstones(ctx context.Context) ([]*Tombstone, error) {
+	iter := ds.client.Collection(tombstoneCollectionID).OrderBy("deleted_at", firestore.Desc).Documents(ctx)
+	tombstones := []*Tombstone{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate tombstone: %w", err)
+		}
+
+		var tombstone Tombstone
+		err = doc.DataTo(&tombstone)
+		if err != nil {
+			return nil, fmt.Errorf("convert from document to tombstone type: %w", err)
+		}
+		tombstones = append(tombstones, &tombstone)
+	}
+	return tombstones, nil
+}
+
+// PurgeTombstones deletes the tombstones that expired before now
+func (ds *DatabaseService) PurgeTombstones(ctx context.Context, now time.Time) error {
+	num, err := ds.purgeExpired(ctx, tombstoneCollectionID, now)
+	if err != nil {
+		return fmt.Errorf("purge expired tombstones: %w", err)
+	}
+	slog.Info("purged expired tombstones", "num", num)
+	return nil
+}
+
+// purgeExpired deletes the documents of a collection whose expires_at is before now, and returns their number
+func (ds *DatabaseService) purgeExpired(ctx context.Context, collectionID string, now time.Time) (int, error) {
+	iter := ds.client.Collection(collectionID).Where("expires_at", "<", now).Documents(ctx)
+	num := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return num, fmt.Errorf("iterate expired document: %w", err)
+		}
+		_, err = doc.Ref.Delete(ctx)
+		if err != nil {
+			return num, fmt.Errorf("delete an expired document: %w", err)
+		}
+		num++
+	}
+	return num, nil
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+)
+
+// ValidationError reports an event listed on a side that cannot be read. The event is skipped until it is fixed.
+type ValidationError struct {
+	Side  string // OriginNotion or OriginGoogleCalendar
+	ID    string // ID of the event on its side
+	UUID  string // Empty if it could not be read
+	Title string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s event %s: %v", e.Side, e.ID, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass tells retry.Class that the event must be fixed
+func (e *ValidationError) ErrorClass() string {
+	return retry.ClassValidation
+}
+
+// Event returns an event with the IDs and title of the invalid event
+func (e *ValidationError) Event() *Event {
+	event := &Event{UUID: e.UUID, Title: e.Title}
+	if e.Side == OriginNotion {
+		event.NotionEventID = e.ID
+	} else {
+		event.GoogleCalendarEventID = e.ID
+	}
+	return event
+}
@@ -2,202 +2,431 @@ package googlecalendar
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
 	"github.com/caarlos0/env/v9"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/slog"
 	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
 )
 
 type Config struct {
 	CalendarID string `env:"GOOGLE_CALENDAR_ID,notEmpty"`
+	// Each pair below maps the values of a Notion select or status property to a Google Calendar event field
+	StatusProperty       string            `env:"GOOGLE_STATUS_PROPERTY"`
+	StatusMap            map[string]string `env:"GOOGLE_STATUS_MAP"`
+	TransparencyProperty string            `env:"GOOGLE_TRANSPARENCY_PROPERTY"`
+	TransparencyMap      map[string]string `env:"GOOGLE_TRANSPARENCY_MAP"`
+	VisibilityProperty   string            `env:"GOOGLE_VISIBILITY_PROPERTY"`
+	VisibilityMap        map[string]string `env:"GOOGLE_VISIBILITY_MAP"`
+	TitlePrefixProperty  string            `env:"GOOGLE_TITLE_PREFIX_PROPERTY"`
+	TitlePrefixMap       map[string]string `env:"GOOGLE_TITLE_PREFIX_MAP"`
 }
 
 type CalendarService struct {
-	service *calendar.Service
-	config  Config
+	service       *calendar.Service
+	config        Config
+	retrier       *retry.Retrier
+	api           *telemetry.API
+	location      *time.Location // Time zone of the calendar, used to write events without a time zone. Read-only.
+	propertyRules []propertyRule
 }
 
-func NewService(ctx context.Context) (*CalendarService, error) {
+func NewService(ctx context.Context, retrier *retry.Retrier) (*CalendarService, error) {
 	srv, err := calendar.NewService(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("create a new service: %v", err)
+		return nil, fmt.Errorf("create a new service: %w", err)
 	}
 	cfg := Config{}
 	if err := env.Parse(&cfg); err != nil {
-		return nil, fmt.Errorf("parse env: %v", err)
+		return nil, fmt.Errorf("parse env: %w", err)
+	}
+	rules, err := newPropertyRules(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create property rules: %w", err)
+	}
+	api, err := telemetry.NewAPI(db.OriginGoogleCalendar)
+	if err != nil {
+		return nil, fmt.Errorf("create api metrics: %w", err)
 	}
 	cs := &CalendarService{
-		service: srv,
-		config:  cfg,
+		service:       srv,
+		config:        cfg,
+		retrier:       retrier,
+		api:           api,
+		propertyRules: rules,
+	}
+	cs.location, err = cs.calendarLocation(ctx)
+	if err != nil {
+		return nil, err
 	}
 	return cs, nil
 }
 
-func (cs *CalendarService) ListEvents() ([]*db.Event, error) {
-	events := []*db.Event{}
-	result, err := cs.service.Events.List(cs.config.CalendarID).TimeMin(time.Now().Format(time.RFC3339)).Do()
+// calendarLocation returns the time zone of the calendar
+func (cs *CalendarService) calendarLocation(ctx context.Context) (*time.Location, error) {
+	var result *calendar.Calendar
+	err := cs.do(ctx, "calendar.calendars.get", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		result, err = cs.service.Calendars.Get(cs.config.CalendarID).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("execute calendar.events.list call: %v", err)
+		return nil, fmt.Errorf("execute calendar.calendars.get call: %w", err)
 	}
-
-	tz, err := time.LoadLocation(result.TimeZone)
+	loc, err := time.LoadLocation(result.TimeZone)
 	if err != nil {
-		return nil, fmt.Errorf("load location: %v", err)
+		return nil, fmt.Errorf("load location: %w", err)
 	}
-	time.Local = tz
+	return loc, nil
+}
 
-	for _, item := range result.Items {
-		event := &db.Event{
-			Title:                 item.Summary,
-			GoogleCalendarEventID: item.Id,
-			Description:           item.Description,
+// ListEvents returns the future events of the calendar, and the events that cannot be read, which are skipped
+func (cs *CalendarService) ListEvents(ctx context.Context) ([]*db.Event, []*db.ValidationError, error) {
+	events := []*db.Event{}
+	invalid := []*db.ValidationError{}
+	// Events cancelled through a status mapping are only returned together with deleted events
+	call := cs.service.Events.List(cs.config.CalendarID).TimeMin(time.Now().Format(time.RFC3339)).ShowDeleted(cs.showCancelled())
+	var result *calendar.Events
+	items := []*calendar.Event{}
+	for {
+		err := cs.do(ctx, "calendar.events.list", retry.Idempotent, func(ctx context.Context) error {
+			var err error
+			result, err = call.Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("execute calendar.events.list call: %w", err)
+		}
+		items = append(items, result.Items...)
+		if result.NextPageToken == "" {
+			break
 		}
+		call.PageToken(result.NextPageToken)
+	}
 
-		createdTime, err := time.Parse(time.RFC3339, item.Created)
+	for _, item := range items {
+		event, err := cs.parseEvent(item)
+		if err != nil && item.Status == statusCancelled { // Deleted events do not need to be readable
+			slog.Debug("skip malformed cancelled google calendar event", "id", item.Id, "error", err)
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("parse created time: %v", err)
+			slog.Warn("skip malformed google calendar event", "id", item.Id, "uuid", event.UUID, "error", err)
+			invalid = append(invalid, &db.ValidationError{
+				Side:  db.OriginGoogleCalendar,
+				ID:    item.Id,
+				UUID:  event.UUID,
+				Title: event.Title,
+				Err:   err,
+			})
+			continue
+		}
+		if item.Status == statusCancelled && !cs.isCancelledBySync(event) { // Deleted by the user
+			continue
 		}
-		event.CreatedTime = createdTime
+		if event.Properties != nil || event.UUID == "" { // Skip events synced before properties were stored
+			cs.readProperties(item, event)
+		}
+
+		slog.Debug("parsed google calendar event", "event", event)
+		events = append(events, event)
+	}
+	slog.Info("listed google calendar events", "num", len(events))
+	cs.api.Listed(ctx, len(events))
+	return events, invalid, nil
+}
+
+// parseEvent converts a Google Calendar event. On error, the returned event has the IDs and title read so far.
+func (cs *CalendarService) parseEvent(item *calendar.Event) (*db.Event, error) {
+	event := &db.Event{
+		Title:                 item.Summary,
+		GoogleCalendarEventID: item.Id,
+		Description:           item.Description,
+		Color:                 item.ColorId,
+	}
+
+	if item.ExtendedProperties != nil {
+		event.UUID = item.ExtendedProperties.Private["uuid"]
+	}
 
-		updatedTime, err := time.Parse(time.RFC3339, item.Updated)
+	createdTime, err := time.Parse(time.RFC3339, item.Created)
+	if err != nil {
+		return event, fmt.Errorf("parse created time: %w", err)
+	}
+	event.CreatedTime = createdTime
+
+	updatedTime, err := time.Parse(time.RFC3339, item.Updated)
+	if err != nil {
+		return event, fmt.Errorf("parse updated time: %w", err)
+	}
+	event.UpdatedTime = updatedTime
+
+	if item.Start == nil || item.End == nil {
+		return event, errors.New("no start or end time")
+	}
+
+	// All day events are kept at midnight UTC so that they do not depend on a time zone
+	startTime := time.Time{}
+	if item.Start.DateTime == "" {
+		startTime, err = time.Parse("2006-01-02", item.Start.Date)
+		if err != nil {
+			return event, fmt.Errorf("parse start time: %w", err)
+		}
+		event.IsAllday = true
+	} else {
+		startTime, err = time.Parse(time.RFC3339, item.Start.DateTime)
 		if err != nil {
-			return nil, fmt.Errorf("parse updated time: %v", err)
+			return event, fmt.Errorf("parse start time: %w", err)
 		}
-		event.UpdatedTime = updatedTime
+	}
+	event.StartTime = startTime
 
-		startTime := time.Time{}
-		if item.Start.DateTime == "" {
-			startTime, err = time.ParseInLocation("2006-01-02", item.Start.Date, tz)
-			if err != nil {
-				return nil, fmt.Errorf("parse start time: %v", err)
-			}
-			event.IsAllday = true
-		} else {
-			startTime, err = time.Parse(time.RFC3339, item.Start.DateTime)
-			if err != nil {
-				return nil, fmt.Errorf("parse start time: %v", err)
-			}
+	endTime := time.Time{}
+	if item.End.DateTime == "" {
+		endTime, err = time.Parse("2006-01-02", item.End.Date)
+		if err != nil {
+			return event, fmt.Errorf("parse end time: %w", err)
+		}
+	} else {
+		endTime, err = time.Parse(time.RFC3339, item.End.DateTime)
+		if err != nil {
+			return event, fmt.Errorf("parse end time: %w", err)
 		}
-		event.StartTime = startTime
+	}
+	event.EndTime = endTime
 
-		endTime := time.Time{}
-		if item.End.DateTime == "" {
-			endTime, err = time.ParseInLocation("2006-01-02", item.End.Date, tz)
-			if err != nil {
-				return nil, fmt.Errorf("parse end time: %v", err)
-			}
-		} else {
-			endTime, err = time.Parse(time.RFC3339, item.End.DateTime)
-			if err != nil {
-				return nil, fmt.Errorf("parse end time: %v", err)
-			}
+	if item.Start.TimeZone != "" && !event.IsAllday {
+		eventLoc, err := time.LoadLocation(item.Start.TimeZone)
+		if err != nil {
+			return event, fmt.Errorf("load location of %s: %w", item.Id, err)
 		}
-		event.EndTime = endTime
+		event.TimeZone = item.Start.TimeZone
+		event.StartTime = event.StartTime.In(eventLoc)
+		event.EndTime = event.EndTime.In(eventLoc)
+	}
 
-		if item.ExtendedProperties != nil {
-			uuid, ok := item.ExtendedProperties.Private["uuid"]
-			if ok {
-				event.UUID = uuid
+	if item.ExtendedProperties != nil {
+		tags, ok := item.ExtendedProperties.Private["tags"]
+		if ok {
+			if err := json.Unmarshal([]byte(tags), &event.Tags); err != nil {
+				return event, fmt.Errorf("parse tags: %w", err)
 			}
 		}
-
-		for k, v := range db.ColorMap {
-			if v == item.ColorId {
-				event.Color = k
-				break
+		properties, ok := item.ExtendedProperties.Private["properties"]
+		if ok {
+			if err := json.Unmarshal([]byte(properties), &event.Properties); err != nil {
+				return event, fmt.Errorf("parse properties: %w", err)
 			}
 		}
-		slog.Debug("parsed google calendar event", "event", event)
-		events = append(events, event)
 	}
-	slog.Info("listed google calendar events", "num", len(events))
-	return events, nil
+	return event, nil
 }
 
-func (cs *CalendarService) InsertEvent(event *db.Event) (string, error) {
-	startDateTime := &calendar.EventDateTime{
-		DateTime: event.StartTime.Format(time.RFC3339),
+// do calls the API, retrying the call if allowed by mode
+func (cs *CalendarService) do(ctx context.Context, name string, mode retry.Mode, fn func(ctx context.Context) error) (err error) {
+	ctx, span := telemetry.Start(ctx, name, attribute.String("provider", db.OriginGoogleCalendar))
+	defer func() { telemetry.End(span, err) }()
+
+	return cs.retrier.Do(ctx, name, mode, func(ctx context.Context) error {
+		start := time.Now()
+		err := fn(ctx)
+		cs.api.Observe(ctx, name, start, err)
+		return err
+	})
+}
+
+// newExtendedProperties stores the UUID, the Notion tags and the Notion properties of an event in private extended properties
+func newExtendedProperties(event *db.Event) (*calendar.EventExtendedProperties, error) {
+	tags := event.Tags
+	if tags == nil {
+		tags = []string{}
 	}
-	endDateTime := &calendar.EventDateTime{
-		DateTime: event.EndTime.Format(time.RFC3339),
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return nil, fmt.Errorf("marshal tags: %w", err)
+	}
+	properties := event.Properties
+	if properties == nil {
+		properties = map[string]string{}
 	}
+	p, err := json.Marshal(properties)
+	if err != nil {
+		return nil, fmt.Errorf("marshal properties: %w", err)
+	}
+	return &calendar.EventExtendedProperties{
+		Private: map[string]string{
+			"uuid":       event.UUID,
+			"tags":       string(b),
+			"properties": string(p),
+		},
+	}, nil
+}
+
+// newEventDateTimes converts the period of an event into the start and end of a Google Calendar event
+func (cs *CalendarService) newEventDateTimes(event *db.Event) (*calendar.EventDateTime, *calendar.EventDateTime) {
 	if event.IsAllday {
-		startDateTime = &calendar.EventDateTime{
-			Date: event.StartTime.Format("2006-01-02"),
+		startDateTime := &calendar.EventDateTime{
+			Date: event.StartTime.UTC().Format("2006-01-02"),
 		}
-		endDateTime = &calendar.EventDateTime{
-			Date: event.EndTime.Format("2006-01-02"),
+		endDateTime := &calendar.EventDateTime{
+			Date: event.EndTime.UTC().Format("2006-01-02"),
 		}
+		return startDateTime, endDateTime
 	}
 
-	e := &calendar.Event{
-		Summary:     event.Title,
-		Description: event.Description,
-		Start:       startDateTime,
-		End:         endDateTime,
-		ExtendedProperties: &calendar.EventExtendedProperties{
-			Private: map[string]string{
-				"uuid": event.UUID,
-			},
-		},
-		ColorId: db.ColorMap[event.Color],
+	loc := event.Location(cs.location)
+	startDateTime := &calendar.EventDateTime{
+		DateTime: event.StartTime.In(loc).Format(time.RFC3339),
+		TimeZone: event.TimeZone,
+	}
+	endDateTime := &calendar.EventDateTime{
+		DateTime: event.EndTime.In(loc).Format(time.RFC3339),
+		TimeZone: event.TimeZone,
 	}
+	return startDateTime, endDateTime
+}
 
-	result, err := cs.service.Events.Insert(cs.config.CalendarID, e).Do()
+// eventID derives the ID of a Google Calendar event from its UUID so that an insertion can be repeated safely
+func eventID(uuid string) string {
+	return strings.ReplaceAll(uuid, "-", "")
+}
+
+// Ping checks that the calendar can be accessed. It is not retried, so that it answers quickly.
+func (cs *CalendarService) Ping(ctx context.Context) error {
+	_, err := cs.service.Calendars.Get(cs.config.CalendarID).Context(ctx).Do()
 	if err != nil {
-		return "", fmt.Errorf("execute calendar.events.insert call: %v", err)
+		return fmt.Errorf("get calendar: %w", err)
 	}
-	slog.Info("inserted google calendar event", "event", result)
-	return result.Id, nil
+	return nil
 }
 
-func (cs *CalendarService) UpdateEvent(event *db.Event) error {
-	startDateTime := &calendar.EventDateTime{
-		DateTime: event.StartTime.Format(time.RFC3339),
+func (cs *CalendarService) InsertEvent(ctx context.Context, event *db.Event) (string, error) {
+	startDateTime, endDateTime := cs.newEventDateTimes(event)
+
+	extendedProperties, err := newExtendedProperties(event)
+	if err != nil {
+		return "", fmt.Errorf("create extended properties: %w", err)
 	}
-	endDateTime := &calendar.EventDateTime{
-		DateTime: event.EndTime.Format(time.RFC3339),
+
+	e := &calendar.Event{
+		Id:                 eventID(event.UUID),
+		Summary:            event.Title,
+		Description:        event.Description,
+		Start:              startDateTime,
+		End:                endDateTime,
+		ExtendedProperties: extendedProperties,
+		ColorId:            event.Color,
 	}
-	if event.IsAllday {
-		startDateTime = &calendar.EventDateTime{
-			Date: event.StartTime.Format("2006-01-02"),
-		}
-		endDateTime = &calendar.EventDateTime{
-			Date: event.EndTime.Format("2006-01-02"),
+	cs.applyProperties(e, event)
+
+	var result *calendar.Event
+	err = cs.do(ctx, "calendar.events.insert", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		result, err = cs.service.Events.Insert(cs.config.CalendarID, e).Context(ctx).Do()
+		return err
+	})
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusConflict {
+		// Inserted by an earlier attempt, or deleted after an earlier insertion
+		slog.Info("google calendar event already exists", "id", e.Id)
+		event.GoogleCalendarEventID = e.Id
+		if err := cs.UpdateEvent(ctx, event); err != nil {
+			return "", fmt.Errorf("update existing event: %w", err)
 		}
+		return e.Id, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("execute calendar.events.insert call: %w", err)
+	}
+	slog.Info("inserted google calendar event", "event", result)
+	return result.Id, nil
+}
+
+func (cs *CalendarService) UpdateEvent(ctx context.Context, event *db.Event) error {
+	startDateTime, endDateTime := cs.newEventDateTimes(event)
+
+	extendedProperties, err := newExtendedProperties(event)
+	if err != nil {
+		return fmt.Errorf("create extended properties: %w", err)
 	}
 
 	e := &calendar.Event{
-		Summary:     event.Title,
-		Description: event.Description,
-		Start:       startDateTime,
-		End:         endDateTime,
-		ExtendedProperties: &calendar.EventExtendedProperties{
-			Private: map[string]string{
-				"uuid": event.UUID,
-			},
-		},
+		Summary:            event.Title,
+		Description:        event.Description,
+		Start:              startDateTime,
+		End:                endDateTime,
+		ExtendedProperties: extendedProperties,
 	}
 	if event.Color != "" {
-		e.ColorId = db.ColorMap[event.Color]
+		e.ColorId = event.Color
+	}
+	cs.applyProperties(e, event)
+	if e.Status == "" { // Restores the event if it has been deleted
+		e.Status = "confirmed"
 	}
 
-	result, err := cs.service.Events.Update(cs.config.CalendarID, event.GoogleCalendarEventID, e).Do()
+	var result *calendar.Event
+	err = cs.do(ctx, "calendar.events.update", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		result, err = cs.service.Events.Update(cs.config.CalendarID, event.GoogleCalendarEventID, e).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("execute calendar.events.update call: %v", err)
+		return fmt.Errorf("execute calendar.events.update call: %w", err)
 	}
 	slog.Info("updated google calendar event", "event", result)
 	return nil
 }
 
-func (cs *CalendarService) DeleteEvent(event *db.Event) error {
-	err := cs.service.Events.Delete(cs.config.CalendarID, event.GoogleCalendarEventID).Do()
+func (cs *CalendarService) DeleteEvent(ctx context.Context, event *db.Event) error {
+	err := cs.do(ctx, "calendar.events.delete", retry.Idempotent, func(ctx context.Context) error {
+		return cs.service.Events.Delete(cs.config.CalendarID, event.GoogleCalendarEventID).Context(ctx).Do()
+	})
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusGone { // Deleted by an earlier attempt
+		err = nil
+	}
 	if err != nil {
-		return fmt.Errorf("execute calendar.events.delete call: %v", err)
+		return fmt.Errorf("execute calendar.events.delete call: %w", err)
 	}
 	slog.Info("deleted google calendar event", "id", event.GoogleCalendarEventID)
 	return nil
 }
+
+// IsDeleted reports whether an event was deleted by the user, that is not found or cancelled
+// other than through the status mapping
+func (cs *CalendarService) IsDeleted(ctx context.Context, eventID string) (bool, error) {
+	var item *calendar.Event
+	err := cs.do(ctx, "calendar.events.get", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		item, err = cs.service.Events.Get(cs.config.CalendarID, eventID).Context(ctx).Do()
+		return err
+	})
+	if IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("execute calendar.events.get call: %w", err)
+	}
+	if item.Status != statusCancelled {
+		return false, nil
+	}
+	event, err := cs.parseEvent(item)
+	return err != nil || !cs.isCancelledBySync(event), nil
+}
+
+// IsNotFound reports whether err was caused by an event that does not exist
+func IsNotFound(err error) bool {
+	var gErr *googleapi.Error
+	return errors.As(err, &gErr) && (gErr.Code == http.StatusNotFound || gErr.Code == http.StatusGone)
+}
@@ -0,0 +1,166 @@
+package googlecalendar
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	fieldStatus       = "status"
+	fieldTransparency = "transparency"
+	fieldVisibility   = "visibility"
+	fieldTitlePrefix  = "title prefix"
+
+	statusCancelled = "cancelled"
+)
+
+// allowedValues lists the values accepted by Google Calendar for each field
+var allowedValues = map[string][]string{
+	fieldStatus:       {"confirmed", "tentative", statusCancelled},
+	fieldTransparency: {"opaque", "transparent"},
+	fieldVisibility:   {"default", "public", "private", "confidential"},
+}
+
+// propertyRule maps the values of a Notion select or status property to a Google Calendar event field
+type propertyRule struct {
+	field    string
+	property string
+	values   map[string]string // Notion value -> Google Calendar value
+}
+
+func newPropertyRules(cfg Config) ([]propertyRule, error) {
+	candidates := []propertyRule{
+		{field: fieldStatus, property: cfg.StatusProperty, values: cfg.StatusMap},
+		{field: fieldTransparency, property: cfg.TransparencyProperty, values: cfg.TransparencyMap},
+		{field: fieldVisibility, property: cfg.VisibilityProperty, values: cfg.VisibilityMap},
+		{field: fieldTitlePrefix, property: cfg.TitlePrefixProperty, values: cfg.TitlePrefixMap},
+	}
+	rules := []propertyRule{}
+	for _, rule := range candidates {
+		if rule.property == "" {
+			continue
+		}
+		if allowed, ok := allowedValues[rule.field]; ok {
+			for _, v := range rule.values {
+				if !slices.Contains(allowed, v) {
+					return nil, fmt.Errorf("invalid %s %q", rule.field, v)
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// get returns the current value of the field of a Google Calendar event
+func (r propertyRule) get(e *calendar.Event) string {
+	switch r.field {
+	case fieldStatus:
+		return e.Status
+	case fieldTransparency:
+		return e.Transparency
+	case fieldVisibility:
+		return e.Visibility
+	}
+	return ""
+}
+
+// set writes value to the field of a Google Calendar event
+func (r propertyRule) set(e *calendar.Event, value string) {
+	switch r.field {
+	case fieldStatus:
+		e.Status = value
+	case fieldTransparency:
+		e.Transparency = value
+	case fieldVisibility:
+		e.Visibility = value
+	case fieldTitlePrefix:
+		e.Summary = value + e.Summary
+	}
+}
+
+// notionValue returns the Notion value mapped to the Google Calendar value, choosing the first in alphabetical order
+func (r propertyRule) notionValue(value string) (string, bool) {
+	keys := maps.Keys(r.values)
+	slices.Sort(keys)
+	for _, k := range keys {
+		if r.values[k] == value {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// applyProperties sets the fields of a Google Calendar event from the Notion properties of an event
+func (cs *CalendarService) applyProperties(e *calendar.Event, event *db.Event) {
+	for _, rule := range cs.propertyRules {
+		if value, ok := rule.values[event.Properties[rule.property]]; ok {
+			rule.set(e, value)
+		}
+	}
+}
+
+// readProperties updates the Notion properties of an event from the fields of a Google Calendar event
+// and strips the title prefix. Properties stored in the extended properties must be set beforehand.
+func (cs *CalendarService) readProperties(item *calendar.Event, event *db.Event) {
+	for _, rule := range cs.propertyRules {
+		current := event.Properties[rule.property]
+		if rule.field == fieldTitlePrefix {
+			if prefix, ok := rule.values[current]; ok && strings.HasPrefix(event.Title, prefix) {
+				event.Title = strings.TrimPrefix(event.Title, prefix)
+				continue
+			}
+			keys := maps.Keys(rule.values)
+			slices.Sort(keys)
+			for _, k := range keys {
+				if prefix := rule.values[k]; prefix != "" && strings.HasPrefix(event.Title, prefix) {
+					event.Title = strings.TrimPrefix(event.Title, prefix)
+					setProperty(event, rule.property, k)
+					break
+				}
+			}
+			continue
+		}
+
+		value := rule.get(item)
+		if mapped, ok := rule.values[current]; ok && mapped == value {
+			continue
+		}
+		if k, ok := rule.notionValue(value); ok {
+			setProperty(event, rule.property, k)
+		}
+	}
+}
+
+// isCancelledBySync reports whether a cancelled event was cancelled because of its Notion properties
+// rather than deleted by the user
+func (cs *CalendarService) isCancelledBySync(event *db.Event) bool {
+	for _, rule := range cs.propertyRules {
+		if rule.field == fieldStatus && rule.values[event.Properties[rule.property]] == statusCancelled {
+			return true
+		}
+	}
+	return false
+}
+
+// showCancelled reports whether any rule maps a value to the cancelled status
+func (cs *CalendarService) showCancelled() bool {
+	for _, rule := range cs.propertyRules {
+		if rule.field == fieldStatus && slices.Contains(maps.Values(rule.values), statusCancelled) {
+			return true
+		}
+	}
+	return false
+}
+
+func setProperty(event *db.Event, key string, value string) {
+	if event.Properties == nil {
+		event.Properties = map[string]string{}
+	}
+	event.Properties[key] = value
+}
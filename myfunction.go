@@ -2,15 +2,23 @@ package mycloudeventfunction
 
 import (
 	"context"
+	"errors"
 	"os"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
 	"github.com/Kitsuya0828/notion-google-calendar-sync/run"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/exp/slog"
 )
 
 func init() {
+	if _, err := telemetry.SetupTracing(); err != nil {
+		slog.Error("set up tracing", "error", err)
+	}
+
 	// Register a CloudEvent function with the Functions Framework
 	functions.CloudEvent("MyCloudEventFunction", myCloudEventFunction)
 }
@@ -26,7 +34,29 @@ func myCloudEventFunction(ctx context.Context, e event.Event) error {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, opt))
 	slog.SetDefault(logger)
 
-	err := run.Run()
+	// Continue the trace of the event (CloudEvents distributed tracing extension)
+	carrier := propagation.MapCarrier{}
+	for _, key := range []string{"traceparent", "tracestate"} {
+		if value, ok := e.Extensions()[key].(string); ok {
+			carrier.Set(key, value)
+		}
+	}
+	ctx = telemetry.Extract(ctx, carrier)
+	// Flushed on every return, since the instance may be frozen afterwards
+	defer func() {
+		if flushErr := telemetry.Flush(ctx); flushErr != nil {
+			slog.Error("flush spans", "error", flushErr)
+		}
+	}()
+
+	report, err := run.Run(ctx, run.Options{Trigger: db.TriggerScheduler})
+	if errors.Is(err, run.ErrAlreadyRunning) { // Not retried, the run in progress does the work
+		slog.Warn("skip run", "reason", err)
+		return nil
+	}
+	// Logged whatever the level of the logs above
+	summary := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	summary.Info("run report", "report", report)
 	if err != nil {
 		return err
 	}
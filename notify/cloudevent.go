@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+// eventTypePrefix is followed by the kind of the notification in the type of the events
+const eventTypePrefix = "com.github.kitsuya0828.notion-google-calendar-sync.notification."
+
+// CloudEvent publishes notifications as CloudEvents over HTTP, for example to an Eventarc or Knative broker
+type CloudEvent struct {
+	client cloudevents.Client
+	target string
+	source string
+}
+
+func newCloudEvent(target string, source string) (*CloudEvent, error) {
+	client, err := cloudevents.NewClientHTTP()
+	if err != nil {
+		return nil, fmt.Errorf("create client: %w", err)
+	}
+	return &CloudEvent{client: client, target: target, source: source}, nil
+}
+
+func (c *CloudEvent) Notify(ctx context.Context, n *Notification) error {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource(c.source)
+	event.SetType(eventTypePrefix + n.Kind)
+	event.SetTime(n.At)
+	if err := event.SetData(cloudevents.ApplicationJSON, n); err != nil {
+		return fmt.Errorf("set data: %w", err)
+	}
+	result := c.client.Send(cloudevents.ContextWithTarget(ctx, c.target), event)
+	if !cloudevents.IsACK(result) {
+		return fmt.Errorf("send event: %w", result)
+	}
+	return nil
+}
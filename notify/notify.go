@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/caarlos0/env/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Kinds of notifications
+const (
+	KindRunFailed   = "run_failed"
+	KindGuard       = "guard"        // A safety guard stopped a run
+	KindConflicts   = "conflicts"    // Conflicts were left to the user
+	KindDeadLetters = "dead_letters" // Events were moved to the dead letters
+)
+
+type Config struct {
+	WebhookURL string `env:"NOTIFY_WEBHOOK_URL"`
+	// SMTPAddr is the host and port of the mail server
+	SMTPAddr         string   `env:"NOTIFY_SMTP_ADDR"`
+	SMTPUsername     string   `env:"NOTIFY_SMTP_USERNAME"`
+	SMTPPassword     string   `env:"NOTIFY_SMTP_PASSWORD"`
+	SMTPFrom         string   `env:"NOTIFY_SMTP_FROM"`
+	SMTPTo           []string `env:"NOTIFY_SMTP_TO"`
+	CloudEventTarget string   `env:"NOTIFY_CLOUDEVENT_TARGET"`
+	CloudEventSource string   `env:"NOTIFY_CLOUDEVENT_SOURCE" envDefault:"notion-google-calendar-sync"`
+	// Throttle is the minimum time between two notifications of the same kind
+	Throttle time.Duration `env:"NOTIFY_THROTTLE" envDefault:"1h"`
+}
+
+// Notification tells about something that needs attention
+type Notification struct {
+	Kind  string    `json:"kind"`
+	Title string    `json:"title"`
+	Text  string    `json:"text"`
+	RunID string    `json:"run_id,omitempty"`
+	At    time.Time `json:"at"`
+	// Suppressed is the number of notifications of the same kind not sent since the last one
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// Notifier sends notifications to a channel
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// Dispatcher sends notifications to all the configured notifiers, at most once per throttle period for each kind
+type Dispatcher struct {
+	config    Config
+	notifiers []Notifier
+	database  *db.DatabaseService
+}
+
+func NewDispatcher(database *db.DatabaseService) (*Dispatcher, error) {
+	cfg := Config{}
+	if err := env.Parse(&cfg); err != nil {
+		return nil, fmt.Errorf("parse env: %w", err)
+	}
+	d := &Dispatcher{config: cfg, database: database}
+	if cfg.WebhookURL != "" {
+		d.notifiers = append(d.notifiers, newWebhook(cfg.WebhookURL))
+	}
+	if cfg.SMTPAddr != "" {
+		n, err := newSMTP(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("create smtp notifier: %w", err)
+		}
+		d.notifiers = append(d.notifiers, n)
+	}
+	if cfg.CloudEventTarget != "" {
+		n, err := newCloudEvent(cfg.CloudEventTarget, cfg.CloudEventSource)
+		if err != nil {
+			return nil, fmt.Errorf("create cloudevent notifier: %w", err)
+		}
+		d.notifiers = append(d.notifiers, n)
+	}
+	return d, nil
+}
+
+// Notify sends a notification unless one of the same kind was sent within the throttle period
+func (d *Dispatcher) Notify(ctx context.Context, n *Notification) error {
+	if len(d.notifiers) == 0 {
+		return nil
+	}
+	send, suppressed, err := d.database.ThrottleNotification(ctx, n.Kind, n.At, d.config.Throttle)
+	if err != nil {
+		return err
+	}
+	if !send {
+		slog.Info("throttle notification", "kind", n.Kind, "title", n.Title)
+		return nil
+	}
+	n.Suppressed = suppressed
+
+	errs := []error{}
+	for _, notifier := range d.notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			errs = append(errs, fmt.Errorf("notify with %T: %w", notifier, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// message returns the text of a notification, mentioning the suppressed ones
+func message(n *Notification) string {
+	text := n.Text
+	if n.RunID != "" {
+		text += "\n\nRun: " + n.RunID
+	}
+	if n.Suppressed > 0 {
+		text += fmt.Sprintf("\n(%d similar notifications suppressed)", n.Suppressed)
+	}
+	return text
+}
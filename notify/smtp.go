@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends notifications by email
+type SMTP struct {
+	addr string
+	auth smtp.Auth // Nil if the server needs no authentication
+	from string
+	to   []string
+}
+
+func newSMTP(cfg Config) (*SMTP, error) {
+	if cfg.SMTPFrom == "" || len(cfg.SMTPTo) == 0 {
+		return nil, errors.New("sender and recipients are required")
+	}
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("parse address: %w", err)
+	}
+	s := &SMTP{addr: cfg.SMTPAddr, from: cfg.SMTPFrom, to: cfg.SMTPTo}
+	if cfg.SMTPUsername != "" {
+		s.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return s, nil
+}
+
+func (s *SMTP) Notify(ctx context.Context, n *Notification) error {
+	header := []string{
+		"From: " + s.from,
+		"To: " + strings.Join(s.to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", n.Title),
+		"Date: " + n.At.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.ReplaceAll(message(n), "\n", "\r\n")
+	msg := strings.Join(header, "\r\n") + "\r\n\r\n" + body + "\r\n"
+
+	// smtp.SendMail does not take a context, so the sending goes on in the background if ctx is done first
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.addr, s.auth, s.from, s.to, []byte(msg)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("send mail: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("send mail: %w", ctx.Err())
+	}
+}
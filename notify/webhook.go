@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook posts notifications as JSON compatible with Slack incoming webhooks
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// webhookPayload has the text field read by Slack, and the notification for other receivers
+type webhookPayload struct {
+	Text string `json:"text"`
+	*Notification
+}
+
+func (w *Webhook) Notify(ctx context.Context, n *Notification) error {
+	// The Text field of the notification is shadowed by the formatted text
+	b, err := json.Marshal(webhookPayload{Text: "*" + n.Title + "*\n" + message(n), Notification: n})
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("post notification: %s", resp.Status)
+	}
+	return nil
+}
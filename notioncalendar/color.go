@@ -0,0 +1,127 @@
+package notioncalendar
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/dstotijn/go-notion"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	precedenceFirst = "first"
+	precedenceLast  = "last"
+)
+
+// colorMapper converts between Notion tags and Google Calendar color IDs
+type colorMapper struct {
+	// tagColors maps a tag name or a Notion option color to a Google Calendar color ID.
+	// Tag names take priority over option colors.
+	tagColors  map[string]string
+	precedence string
+}
+
+func newColorMapper(tagColors map[string]string, precedence string) (*colorMapper, error) {
+	if precedence != precedenceFirst && precedence != precedenceLast {
+		return nil, fmt.Errorf("unknown tag color precedence %q", precedence)
+	}
+	m := &colorMapper{
+		tagColors:  map[string]string{},
+		precedence: precedence,
+	}
+	for k, v := range db.ColorMap {
+		m.tagColors[k] = v
+	}
+	for k, v := range tagColors {
+		m.tagColors[k] = v
+	}
+	return m, nil
+}
+
+// colorOf returns the Google Calendar color ID of a single tag
+func (m *colorMapper) colorOf(option notion.SelectOptions) (string, bool) {
+	if colorID, ok := m.tagColors[option.Name]; ok {
+		return colorID, true
+	}
+	colorID, ok := m.tagColors[string(option.Color)]
+	return colorID, ok
+}
+
+// colorForTags returns the color ID of the tag that wins according to the precedence rule
+func (m *colorMapper) colorForTags(options []notion.SelectOptions) string {
+	for i := range options {
+		option := options[i]
+		if m.precedence == precedenceLast {
+			option = options[len(options)-1-i]
+		}
+		if colorID, ok := m.colorOf(option); ok {
+			return colorID
+		}
+	}
+	return ""
+}
+
+// tagsForColor returns tags whose resulting color is colorID, selecting or adding a tag if necessary.
+// known holds the option colors of the tags defined in the database.
+func (m *colorMapper) tagsForColor(tags []string, colorID string, known map[string]notion.Color) []notion.SelectOptions {
+	options := []notion.SelectOptions{}
+	for _, tag := range tags {
+		options = append(options, notion.SelectOptions{Name: tag, Color: known[tag]})
+	}
+	if colorID == "" || m.colorForTags(options) == colorID {
+		return options
+	}
+
+	// Select a tag that already has the color
+	for i, option := range options {
+		if c, ok := m.colorOf(option); ok && c == colorID {
+			rest := append(options[:i:i], options[i+1:]...)
+			return m.place(rest, option)
+		}
+	}
+
+	// Add a tag mapped to the color by name
+	names := maps.Keys(m.tagColors)
+	slices.Sort(names)
+	for _, name := range names {
+		if _, isColor := db.ColorMap[name]; !isColor && m.tagColors[name] == colorID {
+			return m.place(options, notion.SelectOptions{Name: name, Color: known[name]})
+		}
+	}
+
+	// Add a tag with an option color mapped to the color
+	knownNames := maps.Keys(known)
+	slices.Sort(knownNames)
+	for _, name := range knownNames {
+		option := notion.SelectOptions{Name: name, Color: known[name]}
+		if c, ok := m.colorOf(option); ok && c == colorID {
+			return m.place(options, option)
+		}
+	}
+	for _, color := range names {
+		if _, isColor := db.ColorMap[color]; isColor && m.tagColors[color] == colorID {
+			return m.place(options, notion.SelectOptions{Name: color, Color: notion.Color(color)})
+		}
+	}
+	return options
+}
+
+// place puts option where the precedence rule makes it win
+func (m *colorMapper) place(options []notion.SelectOptions, option notion.SelectOptions) []notion.SelectOptions {
+	if m.precedence == precedenceLast {
+		return append(options, option)
+	}
+	return append([]notion.SelectOptions{option}, options...)
+}
+
+// tagOptions returns a copy of the option colors of the tags defined in the database
+func (cs *CalendarService) tagOptions(ctx context.Context) (map[string]notion.Color, error) {
+	if err := cs.loadSchema(ctx); err != nil {
+		return nil, err
+	}
+	cs.schemaMu.Lock()
+	defer cs.schemaMu.Unlock()
+	return maps.Clone(cs.knownTags), nil
+}
@@ -0,0 +1,172 @@
+package notioncalendar
+
+import (
+	"testing"
+
+	"github.com/dstotijn/go-notion"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func TestNewColorMapper(t *testing.T) {
+	if _, err := newColorMapper(nil, "middle"); err == nil {
+		t.Error("newColorMapper() with an unknown precedence error = nil, want an error")
+	}
+}
+
+func TestColorForTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		tagColors  map[string]string
+		precedence string
+		options    []notion.SelectOptions
+		want       string
+	}{
+		{
+			name:       "no tags",
+			precedence: precedenceFirst,
+			want:       "",
+		},
+		{
+			name:       "option color",
+			precedence: precedenceFirst,
+			options:    []notion.SelectOptions{{Name: "Urgent", Color: notion.ColorRed}},
+			want:       "11",
+		},
+		{
+			name:       "tag name before option color",
+			tagColors:  map[string]string{"Work": "9"},
+			precedence: precedenceFirst,
+			options:    []notion.SelectOptions{{Name: "Work", Color: notion.ColorRed}},
+			want:       "9",
+		},
+		{
+			name:       "option color overridden",
+			tagColors:  map[string]string{"red": "4"},
+			precedence: precedenceFirst,
+			options:    []notion.SelectOptions{{Name: "Urgent", Color: notion.ColorRed}},
+			want:       "4",
+		},
+		{
+			name:       "first tag wins",
+			precedence: precedenceFirst,
+			options:    []notion.SelectOptions{{Name: "A", Color: notion.ColorRed}, {Name: "B", Color: notion.ColorBlue}},
+			want:       "11",
+		},
+		{
+			name:       "last tag wins",
+			precedence: precedenceLast,
+			options:    []notion.SelectOptions{{Name: "A", Color: notion.ColorRed}, {Name: "B", Color: notion.ColorBlue}},
+			want:       "9",
+		},
+		{
+			name:       "unmapped tags are skipped",
+			precedence: precedenceFirst,
+			options:    []notion.SelectOptions{{Name: "A"}, {Name: "B", Color: notion.ColorBlue}},
+			want:       "9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newColorMapper(tt.tagColors, tt.precedence)
+			if err != nil {
+				t.Fatalf("newColorMapper() error = %v", err)
+			}
+			if got := m.colorForTags(tt.options); got != tt.want {
+				t.Errorf("colorForTags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagsForColor(t *testing.T) {
+	known := map[string]notion.Color{
+		"Home":   notion.ColorBlue,
+		"Urgent": notion.ColorRed,
+	}
+	tests := []struct {
+		name       string
+		tagColors  map[string]string
+		precedence string
+		tags       []string
+		colorID    string
+		want       []string
+	}{
+		{
+			name:       "no color",
+			precedence: precedenceFirst,
+			tags:       []string{"Home"},
+			want:       []string{"Home"},
+		},
+		{
+			name:       "color given by the tags",
+			precedence: precedenceFirst,
+			tags:       []string{"Home", "Urgent"},
+			colorID:    "9",
+			want:       []string{"Home", "Urgent"},
+		},
+		{
+			name:       "tag with the color moved first",
+			precedence: precedenceFirst,
+			tags:       []string{"Home", "Urgent"},
+			colorID:    "11",
+			want:       []string{"Urgent", "Home"},
+		},
+		{
+			name:       "tag with the color moved last",
+			precedence: precedenceLast,
+			tags:       []string{"Urgent", "Home"},
+			colorID:    "11",
+			want:       []string{"Home", "Urgent"},
+		},
+		{
+			name:       "tag mapped by name added",
+			tagColors:  map[string]string{"Work": "9"},
+			precedence: precedenceFirst,
+			colorID:    "9",
+			want:       []string{"Work"},
+		},
+		{
+			name:       "known tag with the option color added",
+			precedence: precedenceFirst,
+			tags:       []string{"Home"},
+			colorID:    "11",
+			want:       []string{"Urgent", "Home"},
+		},
+		{
+			name:       "tag named after the option color added",
+			precedence: precedenceLast,
+			tags:       []string{"Home"},
+			colorID:    "5",
+			want:       []string{"Home", "yellow"},
+		},
+		{
+			name:       "unknown color",
+			precedence: precedenceFirst,
+			tags:       []string{"Home"},
+			colorID:    "99",
+			want:       []string{"Home"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newColorMapper(tt.tagColors, tt.precedence)
+			if err != nil {
+				t.Fatalf("newColorMapper() error = %v", err)
+			}
+			options := m.tagsForColor(tt.tags, tt.colorID, known)
+			names := []string{}
+			for _, option := range options {
+				names = append(names, option.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Fatalf("tagsForColor() = %v, want %v", names, tt.want)
+			}
+			if slices.Contains(maps.Values(m.tagColors), tt.colorID) { // The tags give a mapped color back
+				if got := m.colorForTags(options); got != tt.colorID {
+					t.Errorf("colorForTags(tagsForColor()) = %q, want %q", got, tt.colorID)
+				}
+			}
+		})
+	}
+}
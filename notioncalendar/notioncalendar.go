@@ -2,11 +2,16 @@ package notioncalendar
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
 	"github.com/caarlos0/env/v9"
 	"github.com/dstotijn/go-notion"
 	"golang.org/x/exp/slog"
@@ -20,27 +25,75 @@ type Config struct {
 	TagsPropertyName        string `env:"NOTION_TAGS_PROPERTY_NAME" envDefault:"Tags"`
 	DatePropertyName        string `env:"NOTION_DATE_PROPERTY_NAME" envDefault:"Date"`
 	UUIDPropertyName        string `env:"NOTION_UUID_PROPERTY_NAME" envDefault:"UUID"`
+	// RateLimit is the average number of requests per second, Notion allows an average of three
+	RateLimit float64 `env:"NOTION_RATE_LIMIT" envDefault:"3"`
+	RateBurst int     `env:"NOTION_RATE_BURST" envDefault:"3"`
+	// TagColors maps a tag name or a Notion option color to a Google Calendar color ID (e.g. "Work:9,red:11")
+	TagColors map[string]string `env:"NOTION_TAG_COLORS"`
+	// TagColorPrecedence decides which tag gives the color when an event has multiple tags ("first" or "last")
+	TagColorPrecedence string `env:"NOTION_TAG_COLOR_PRECEDENCE" envDefault:"first"`
+	// ConflictPropertyName is a checkbox flagging pages with unresolved conflicts, and ConflictDetailPropertyName
+	// a rich text showing the values on Google Calendar. Conflicts are not shown on Notion if they are empty.
+	ConflictPropertyName       string `env:"NOTION_CONFLICT_PROPERTY_NAME"`
+	ConflictDetailPropertyName string `env:"NOTION_CONFLICT_DETAIL_PROPERTY_NAME"`
 }
 
 type CalendarService struct {
-	client *notion.Client
-	config Config
+	client        *notion.Client
+	httpClient    *http.Client // Used for the requests go-notion cannot make
+	config        Config
+	retrier       *retry.Retrier
+	limiter       *rateLimiter
+	api           *telemetry.API
+	location      *time.Location // Used to write events without a time zone
+	colorMapper   *colorMapper
+	knownTags     map[string]notion.Color
+	propertyTypes map[string]notion.DatabasePropertyType
+	schemaLoaded  bool
+	schemaMu      sync.Mutex // Guards knownTags, propertyTypes and schemaLoaded
 }
 
-func NewService() (*CalendarService, error) {
+func NewService(retrier *retry.Retrier) (*CalendarService, error) {
 	cfg := Config{}
 	if err := env.Parse(&cfg); err != nil {
-		return nil, fmt.Errorf("parse env: %v", err)
+		return nil, fmt.Errorf("parse env: %w", err)
 	}
-	c := notion.NewClient(cfg.Token)
+	loc, err := time.LoadLocation(cfg.DefaultTimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("load location: %w", err)
+	}
+	m, err := newColorMapper(cfg.TagColors, cfg.TagColorPrecedence)
+	if err != nil {
+		return nil, fmt.Errorf("create color mapper: %w", err)
+	}
+	api, err := telemetry.NewAPI(db.OriginNotion)
+	if err != nil {
+		return nil, fmt.Errorf("create api metrics: %w", err)
+	}
+	httpClient := &http.Client{Transport: &retry.Transport{}}
+	c := notion.NewClient(cfg.Token, notion.WithHTTPClient(httpClient))
 	cs := &CalendarService{
-		client: c,
-		config: cfg,
+		client:        c,
+		httpClient:    httpClient,
+		config:        cfg,
+		retrier:       retrier,
+		limiter:       newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		api:           api,
+		location:      loc,
+		colorMapper:   m,
+		knownTags:     map[string]notion.Color{},
+		propertyTypes: map[string]notion.DatabasePropertyType{},
 	}
 	return cs, nil
 }
 
-func (cs *CalendarService) ListEvents(ctx context.Context) ([]*db.Event, error) {
+// Location returns the time zone in which events without a time zone are written
+func (cs *CalendarService) Location() *time.Location {
+	return cs.location
+}
+
+// ListEvents returns the future events of the database, and the pages that cannot be read, which are skipped
+func (cs *CalendarService) ListEvents(ctx context.Context) ([]*db.Event, []*db.ValidationError, error) {
 	now := time.Now()
 	req := &notion.DatabaseQuery{
 		Filter: &notion.DatabaseQueryFilter{
@@ -54,89 +107,33 @@ func (cs *CalendarService) ListEvents(ctx context.Context) ([]*db.Event, error)
 	}
 
 	events := []*db.Event{}
-
-	loc, err := time.LoadLocation(cs.config.DefaultTimeZone)
-	if err != nil {
-		return nil, fmt.Errorf("load location: %v", err)
-	}
-	time.Local = loc
+	invalid := []*db.ValidationError{}
 
 	for {
-		response, err := cs.client.QueryDatabase(ctx, cs.config.DatabaseID, req)
+		var response notion.DatabaseQueryResponse
+		err := cs.do(ctx, "notion query database", retry.Idempotent, func(ctx context.Context) error {
+			var err error
+			response, err = cs.client.QueryDatabase(ctx, cs.config.DatabaseID, req)
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("query database: %v", err)
+			return nil, nil, fmt.Errorf("query database: %w", err)
 		}
 		result := response.Results
 
 		for _, page := range result {
-			event := &db.Event{NotionEventID: page.ID}
-
-			props, ok := page.Properties.(notion.DatabasePageProperties)
-			if !ok {
-				slog.Error("type assertion failed", "page.Properties", page.Properties)
+			event, err := cs.parsePage(page)
+			if err != nil {
+				slog.Warn("skip malformed notion event", "id", page.ID, "uuid", event.UUID, "error", err)
+				invalid = append(invalid, &db.ValidationError{
+					Side:  db.OriginNotion,
+					ID:    page.ID,
+					UUID:  event.UUID,
+					Title: event.Title,
+					Err:   err,
+				})
 				continue
 			}
-
-			for key, prop := range props {
-				switch pt := prop.Type; pt {
-				case "title":
-					titles := []string{}
-					for _, rt := range prop.Title {
-						titles = append(titles, rt.Text.Content)
-					}
-					event.Title = strings.Join(titles, "\n")
-				case "multi_select":
-					for _, o := range prop.MultiSelect {
-						if key == cs.config.TagsPropertyName {
-							event.Color = string(o.Color)
-							break
-						}
-					}
-				case "created_time":
-					event.CreatedTime = *prop.CreatedTime
-				case "last_edited_time":
-					event.UpdatedTime = *prop.LastEditedTime
-				case "rich_text":
-					descriptions := []string{}
-					for _, rt := range prop.RichText {
-						if key == cs.config.UUIDPropertyName {
-							event.UUID = rt.Text.Content
-							break
-						} else if key == cs.config.DescriptionPropertyName {
-							descriptions = append(descriptions, rt.Text.Content)
-						}
-					}
-					if len(descriptions) > 0 {
-						event.Description = strings.Join(descriptions, "\n")
-					}
-				case "date":
-					event.StartTime = prop.Date.Start.Time
-					if !prop.Date.Start.HasTime() { // All day
-						st := event.StartTime
-						event.StartTime = time.Date(st.Year(), st.Month(), st.Day(), 0, 0, 0, 0, loc)
-						event.IsAllday = true
-					}
-					if prop.Date.End != nil {
-						event.EndTime = prop.Date.End.Time
-						if !prop.Date.End.HasTime() { // All day (more than 2 days)
-							et := event.EndTime
-							event.EndTime = time.Date(et.Year(), et.Month(), et.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
-						}
-					} else {
-						if event.IsAllday { // All day (1 day)
-							event.EndTime = event.StartTime.AddDate(0, 0, 1)
-						} else {
-							// If no end time is specified and it is not an all day event, set the duration to 1 hour
-							event.EndTime = event.StartTime.Add(time.Hour)
-						}
-					}
-					// if prop.Date.TimeZone != nil {
-					// 	fmt.Println(prop.Date.TimeZone)
-					// }
-				default:
-					slog.Debug("property type unsupported", "type", pt)
-				}
-			}
 			slog.Debug("parsed notion event", "event", event)
 			events = append(events, event)
 		}
@@ -148,22 +145,172 @@ func (cs *CalendarService) ListEvents(ctx context.Context) ([]*db.Event, error)
 		}
 	}
 	slog.Info("listed notion events", "num", len(events))
-	return events, nil
+	cs.api.Listed(ctx, len(events))
+	return events, invalid, nil
 }
 
-func (cs *CalendarService) CreateEvent(ctx context.Context, event *db.Event) (string, error) {
-	date := &notion.Date{
-		Start: notion.NewDateTime(event.StartTime, !event.IsAllday),
+// parsePage converts a page of the database. On error, the returned event has the IDs and title read so far.
+func (cs *CalendarService) parsePage(page notion.Page) (*db.Event, error) {
+	event := &db.Event{NotionEventID: page.ID}
+
+	props, ok := page.Properties.(notion.DatabasePageProperties)
+	if !ok {
+		return event, fmt.Errorf("unexpected properties of type %T", page.Properties)
 	}
 
+	// Properties are read in any order, so the rest of the page is still read after an error
+	errs := []error{}
+	for key, prop := range props {
+		switch pt := prop.Type; pt {
+		case "title":
+			titles := []string{}
+			for _, rt := range prop.Title {
+				titles = append(titles, rt.Text.Content)
+			}
+			event.Title = strings.Join(titles, "\n")
+		case "multi_select":
+			if key == cs.config.TagsPropertyName {
+				cs.schemaMu.Lock()
+				for _, o := range prop.MultiSelect {
+					event.Tags = append(event.Tags, o.Name)
+					cs.knownTags[o.Name] = o.Color
+				}
+				cs.schemaMu.Unlock()
+				event.Color = cs.colorMapper.colorForTags(prop.MultiSelect)
+			}
+		case "select", "status":
+			cs.schemaMu.Lock()
+			cs.propertyTypes[key] = pt
+			cs.schemaMu.Unlock()
+			if value := selectedName(prop); value != "" {
+				if event.Properties == nil {
+					event.Properties = map[string]string{}
+				}
+				event.Properties[key] = value
+			}
+		case "checkbox":
+			if key == cs.config.ConflictPropertyName {
+				event.ConflictFlagged = *prop.Checkbox
+			}
+		case "created_time":
+			event.CreatedTime = *prop.CreatedTime
+		case "last_edited_time":
+			event.UpdatedTime = *prop.LastEditedTime
+		case "rich_text":
+			descriptions := []string{}
+			for _, rt := range prop.RichText {
+				if key == cs.config.UUIDPropertyName {
+					event.UUID = rt.Text.Content
+					break
+				} else if key == cs.config.DescriptionPropertyName {
+					descriptions = append(descriptions, rt.Text.Content)
+				}
+			}
+			if len(descriptions) > 0 {
+				event.Description = strings.Join(descriptions, "\n")
+			}
+		case "date":
+			if prop.Date == nil {
+				if key == cs.config.DatePropertyName {
+					errs = append(errs, errors.New("no date"))
+				}
+				continue
+			}
+			// All day events are kept at midnight UTC so that they do not depend on a time zone
+			event.StartTime = prop.Date.Start.Time
+			if !prop.Date.Start.HasTime() { // All day
+				event.IsAllday = true
+			}
+			if prop.Date.End != nil {
+				event.EndTime = prop.Date.End.Time
+				if !prop.Date.End.HasTime() { // All day (more than 2 days)
+					event.EndTime = event.EndTime.AddDate(0, 0, 1)
+				}
+			} else {
+				if event.IsAllday { // All day (1 day)
+					event.EndTime = event.StartTime.AddDate(0, 0, 1)
+				} else {
+					// If no end time is specified and it is not an all day event, set the duration to 1 hour
+					event.EndTime = event.StartTime.Add(time.Hour)
+				}
+			}
+			if prop.Date.TimeZone != nil && !event.IsAllday {
+				loc, err := time.LoadLocation(*prop.Date.TimeZone)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("load location: %w", err))
+					continue
+				}
+				event.TimeZone = *prop.Date.TimeZone
+				event.StartTime = event.StartTime.In(loc)
+				event.EndTime = event.EndTime.In(loc)
+			}
+		default:
+			slog.Debug("property type unsupported", "type", pt)
+		}
+	}
+	return event, errors.Join(errs...)
+}
+
+// FindEventID returns the ID of the page whose UUID property is uuid, or an empty string if there is none
+func (cs *CalendarService) FindEventID(ctx context.Context, uuid string) (string, error) {
+	req := &notion.DatabaseQuery{
+		Filter: &notion.DatabaseQueryFilter{
+			Property: cs.config.UUIDPropertyName,
+			DatabaseQueryPropertyFilter: notion.DatabaseQueryPropertyFilter{
+				RichText: &notion.TextPropertyFilter{
+					Equals: uuid,
+				},
+			},
+		},
+	}
+	var response notion.DatabaseQueryResponse
+	err := cs.do(ctx, "notion query database", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		response, err = cs.client.QueryDatabase(ctx, cs.config.DatabaseID, req)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("query database: %w", err)
+	}
+	if len(response.Results) == 0 {
+		return "", nil
+	}
+	return response.Results[0].ID, nil
+}
+
+// newDate converts the period of an event into a Notion date.
+// The time zone is expressed as the UTC offset since Notion does not accept both.
+func (cs *CalendarService) newDate(event *db.Event) *notion.Date {
 	if event.IsAllday { // All day event
-		endTime := notion.NewDateTime(event.EndTime.AddDate(0, 0, -1), false)
+		date := &notion.Date{
+			Start: notion.NewDateTime(event.StartTime.UTC(), false),
+		}
+		endTime := notion.NewDateTime(event.EndTime.UTC().AddDate(0, 0, -1), false)
 		if date.Start != endTime { // All day event (more than 2 days)
 			date.End = &endTime
 		}
-	} else {
-		endTime := notion.NewDateTime(event.EndTime, true)
-		date.End = &endTime
+		return date
+	}
+
+	loc := event.Location(cs.location)
+	endTime := notion.NewDateTime(event.EndTime.In(loc), true)
+	return &notion.Date{
+		Start: notion.NewDateTime(event.StartTime.In(loc), true),
+		End:   &endTime,
+	}
+}
+
+func (cs *CalendarService) CreateEvent(ctx context.Context, event *db.Event) (string, error) {
+	date := cs.newDate(event)
+
+	knownTags, err := cs.tagOptions(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get tag options: %w", err)
+	}
+	tags := cs.colorMapper.tagsForColor(event.Tags, event.Color, knownTags)
+	event.Tags = []string{}
+	for _, tag := range tags {
+		event.Tags = append(event.Tags, tag.Name)
 	}
 
 	params := notion.CreatePageParams{
@@ -203,27 +350,36 @@ func (cs *CalendarService) CreateEvent(ctx context.Context, event *db.Event) (st
 		},
 	}
 
-	page, err := cs.client.CreatePage(ctx, params)
+	cleared := map[string]notion.DatabasePropertyType{}
+	cs.tagsProperty(*params.DatabasePageProperties, cleared, tags)
+	// A new page has no select to clear, and its statuses keep their default option
+	cs.selectProperties(event, *params.DatabasePageProperties, map[string]notion.DatabasePropertyType{})
+
+	// A page is not created twice since only rejected requests are retried
+	var page notion.Page
+	err = cs.do(ctx, "notion create page", retry.NotIdempotent, func(ctx context.Context) error {
+		var err error
+		page, err = cs.sendPage(ctx, http.MethodPost, "/pages", params, cleared)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("call api to create a page: %v", err)
+		return "", fmt.Errorf("call api to create a page: %w", err)
 	}
 	slog.Info("created notion event", "page", page)
 	return page.ID, nil
 }
 
 func (cs *CalendarService) UpdateEvent(ctx context.Context, event *db.Event) error {
-	date := &notion.Date{
-		Start: notion.NewDateTime(event.StartTime, !event.IsAllday),
-	}
+	date := cs.newDate(event)
 
-	if event.IsAllday { // All day event
-		endTime := notion.NewDateTime(event.EndTime.AddDate(0, 0, -1), false)
-		if date.Start != endTime { // All day event (more than 2 days)
-			date.End = &endTime
-		}
-	} else {
-		endTime := notion.NewDateTime(event.EndTime, true)
-		date.End = &endTime
+	knownTags, err := cs.tagOptions(ctx)
+	if err != nil {
+		return fmt.Errorf("get tag options: %w", err)
+	}
+	tags := cs.colorMapper.tagsForColor(event.Tags, event.Color, knownTags)
+	event.Tags = []string{}
+	for _, tag := range tags {
+		event.Tags = append(event.Tags, tag.Name)
 	}
 
 	params := notion.UpdatePageParams{
@@ -261,23 +417,130 @@ func (cs *CalendarService) UpdateEvent(ctx context.Context, event *db.Event) err
 		},
 	}
 
-	result, err := cs.client.UpdatePage(ctx, event.NotionEventID, params)
+	cleared := map[string]notion.DatabasePropertyType{}
+	cs.tagsProperty(params.DatabasePageProperties, cleared, tags)
+	cs.selectProperties(event, params.DatabasePageProperties, cleared)
+
+	var result notion.Page
+	err = cs.do(ctx, "notion update page", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		result, err = cs.sendPage(ctx, http.MethodPatch, "/pages/"+event.NotionEventID, params, cleared)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("call api to update a page: %v", err)
+		return fmt.Errorf("call api to update a page: %w", err)
 	}
 	slog.Info("updated notion event", "page", result)
 	return nil
 }
 
+// Ping checks that the database can be read. It is not retried, so that it answers quickly.
+func (cs *CalendarService) Ping(ctx context.Context) error {
+	_, err := cs.client.FindDatabaseByID(ctx, cs.config.DatabaseID)
+	if err != nil {
+		return fmt.Errorf("find database: %w", err)
+	}
+	return nil
+}
+
+// FlagsConflicts reports whether unresolved conflicts are shown on Notion pages
+func (cs *CalendarService) FlagsConflicts() bool {
+	return cs.config.ConflictPropertyName != ""
+}
+
+// SetConflict flags the page of an event with an unresolved conflict, or clears the flag if detail is empty
+func (cs *CalendarService) SetConflict(ctx context.Context, event *db.Event, detail string) error {
+	if !cs.FlagsConflicts() {
+		return nil
+	}
+	flagged := detail != ""
+	if runes := []rune(detail); len(runes) > 2000 { // Notion limits a text to 2000 characters
+		detail = string(runes[:2000])
+	}
+	params := notion.UpdatePageParams{
+		DatabasePageProperties: notion.DatabasePageProperties{
+			cs.config.ConflictPropertyName: notion.DatabasePageProperty{
+				Checkbox: &flagged,
+			},
+		},
+	}
+	if cs.config.ConflictDetailPropertyName != "" {
+		params.DatabasePageProperties[cs.config.ConflictDetailPropertyName] = notion.DatabasePageProperty{
+			RichText: []notion.RichText{
+				{
+					Text: &notion.Text{
+						Content: detail,
+					},
+				},
+			},
+		}
+	}
+
+	err := cs.do(ctx, "notion update page", retry.Idempotent, func(ctx context.Context) error {
+		_, err := cs.client.UpdatePage(ctx, event.NotionEventID, params)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("call api to flag a page with a conflict: %w", err)
+	}
+	event.ConflictFlagged = flagged
+	slog.Info("set conflict on notion event", "uuid", event.UUID, "flagged", flagged)
+	return nil
+}
+
 func (cs *CalendarService) DeleteEvent(ctx context.Context, event *db.Event) error {
 	archived := true
 	params := notion.UpdatePageParams{
 		Archived: &archived,
 	}
-	result, err := cs.client.UpdatePage(ctx, event.NotionEventID, params)
+	var result notion.Page
+	err := cs.do(ctx, "notion archive page", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		result, err = cs.client.UpdatePage(ctx, event.NotionEventID, params)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("call api to archive a page: %v", err)
+		return fmt.Errorf("call api to archive a page: %w", err)
 	}
 	slog.Info("deleted notion event", "page", result)
 	return nil
 }
+
+// IsDeleted reports whether the page of an event was deleted, that is archived or not found
+func (cs *CalendarService) IsDeleted(ctx context.Context, pageID string) (bool, error) {
+	var page notion.Page
+	err := cs.do(ctx, "notion find page", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		page, err = cs.client.FindPageByID(ctx, pageID)
+		return err
+	})
+	if errors.Is(err, notion.ErrObjectNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("call api to find a page: %w", err)
+	}
+	return page.Archived, nil
+}
+
+// RestoreEvent takes an archived page out of the trash and writes the event to it
+func (cs *CalendarService) RestoreEvent(ctx context.Context, event *db.Event) error {
+	archived := false
+	params := notion.UpdatePageParams{
+		Archived: &archived,
+	}
+	err := cs.do(ctx, "notion restore page", retry.Idempotent, func(ctx context.Context) error {
+		_, err := cs.client.UpdatePage(ctx, event.NotionEventID, params)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("call api to restore a page: %w", err)
+	}
+	slog.Info("restored notion event", "id", event.NotionEventID)
+	return cs.UpdateEvent(ctx, event)
+}
+
+// IsNotFound reports whether err was caused by a page that does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, notion.ErrObjectNotFound)
+}
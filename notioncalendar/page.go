@@ -0,0 +1,83 @@
+package notioncalendar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dstotijn/go-notion"
+)
+
+const (
+	apiURL     = "https://api.notion.com/v1"
+	apiVersion = "2022-06-28" // Same as go-notion
+)
+
+// sendPage sends a request creating or updating a page with params, in which the properties in cleared are set to
+// no value. go-notion leaves empty multi-selects and nil selects out of its requests, so it cannot clear them.
+func (cs *CalendarService) sendPage(
+	ctx context.Context,
+	method string,
+	path string,
+	params any,
+	cleared map[string]notion.DatabasePropertyType,
+) (notion.Page, error) {
+	var page notion.Page
+	body, err := json.Marshal(params)
+	if err != nil {
+		return page, fmt.Errorf("marshal params: %w", err)
+	}
+	if len(cleared) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return page, fmt.Errorf("unmarshal params: %w", err)
+		}
+		props := map[string]json.RawMessage{}
+		if raw, ok := fields["properties"]; ok {
+			if err := json.Unmarshal(raw, &props); err != nil {
+				return page, fmt.Errorf("unmarshal properties: %w", err)
+			}
+		}
+		for name, propType := range cleared {
+			empty := "null"
+			if propType == notion.DBPropTypeMultiSelect {
+				empty = "[]"
+			}
+			props[name] = json.RawMessage(fmt.Sprintf(`{%q:%s}`, propType, empty))
+		}
+		if fields["properties"], err = json.Marshal(props); err != nil {
+			return page, fmt.Errorf("marshal properties: %w", err)
+		}
+		if body, err = json.Marshal(fields); err != nil {
+			return page, fmt.Errorf("marshal params: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return page, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cs.config.Token)
+	req.Header.Set("Notion-Version", apiVersion)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := cs.httpClient.Do(req)
+	if err != nil {
+		return page, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		// Decoded as go-notion does, so that errors are classified alike
+		apiErr := &notion.APIError{}
+		if err := json.NewDecoder(res.Body).Decode(apiErr); err != nil {
+			return page, &notion.APIError{Status: res.StatusCode}
+		}
+		return page, apiErr
+	}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return page, fmt.Errorf("decode page: %w", err)
+	}
+	return page, nil
+}
@@ -0,0 +1,124 @@
+package notioncalendar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/dstotijn/go-notion"
+	"golang.org/x/exp/maps"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// capture returns a service whose requests get the given response, and the body of the last request
+func capture(t *testing.T, status int, response string) (*CalendarService, *map[string]map[string]json.RawMessage) {
+	t.Helper()
+	body := map[string]map[string]json.RawMessage{}
+	cs := &CalendarService{httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("decode request body: %v", err)
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader(response)),
+			Header:     http.Header{},
+		}, nil
+	})}}
+	return cs, &body
+}
+
+func TestSendPageClearsProperties(t *testing.T) {
+	cs, body := capture(t, http.StatusOK, `{"object":"page","id":"page-id","parent":{"type":"database_id","database_id":"database-id"},"properties":{}}`)
+	params := notion.UpdatePageParams{
+		DatabasePageProperties: notion.DatabasePageProperties{
+			"Tags": notion.DatabasePageProperty{MultiSelect: []notion.SelectOptions{}},
+		},
+	}
+	cleared := map[string]notion.DatabasePropertyType{
+		"Tags":   notion.DBPropTypeMultiSelect,
+		"Stage":  notion.DBPropTypeSelect,
+		"Status": notion.DBPropTypeStatus,
+	}
+	page, err := cs.sendPage(context.Background(), http.MethodPatch, "/pages/page-id", params, cleared)
+	if err != nil {
+		t.Fatalf("sendPage() error = %v", err)
+	}
+	if page.ID != "page-id" {
+		t.Errorf("page ID = %q, want %q", page.ID, "page-id")
+	}
+	want := map[string]string{
+		"Tags":   `{"multi_select":[]}`,
+		"Stage":  `{"select":null}`,
+		"Status": `{"status":null}`,
+	}
+	for name, value := range want {
+		if got := string((*body)["properties"][name]); got != value {
+			t.Errorf("property %s = %s, want %s", name, got, value)
+		}
+	}
+}
+
+func TestSendPageKeepsProperties(t *testing.T) {
+	cs, body := capture(t, http.StatusOK, `{"object":"page","id":"page-id","parent":{"type":"database_id","database_id":"database-id"},"properties":{}}`)
+	params := notion.CreatePageParams{
+		ParentType: notion.ParentTypeDatabase,
+		ParentID:   "database-id",
+		DatabasePageProperties: &notion.DatabasePageProperties{
+			"Tags": notion.DatabasePageProperty{MultiSelect: []notion.SelectOptions{{Name: "Work"}}},
+		},
+	}
+	_, err := cs.sendPage(context.Background(), http.MethodPost, "/pages", params, nil)
+	if err != nil {
+		t.Fatalf("sendPage() error = %v", err)
+	}
+	if got, want := string((*body)["properties"]["Tags"]), `{"multi_select":[{"name":"Work"}]}`; got != want {
+		t.Errorf("tags = %s, want %s", got, want)
+	}
+	if got, want := string((*body)["parent"]["database_id"]), `"database-id"`; got != want {
+		t.Errorf("parent = %s, want %s", got, want)
+	}
+}
+
+func TestSendPageError(t *testing.T) {
+	cs, _ := capture(t, http.StatusBadRequest, `{"object":"error","status":400,"code":"validation_error","message":"invalid"}`)
+	_, err := cs.sendPage(context.Background(), http.MethodPatch, "/pages/page-id", notion.UpdatePageParams{}, nil)
+	if err == nil {
+		t.Fatal("sendPage() error = nil, want a validation error")
+	}
+	if !errors.Is(err, notion.ErrValidation) {
+		t.Errorf("sendPage() error = %v, want %v", err, notion.ErrValidation)
+	}
+}
+
+func TestSelectProperties(t *testing.T) {
+	cs := &CalendarService{propertyTypes: map[string]notion.DatabasePropertyType{
+		"Stage":  notion.DBPropTypeSelect,
+		"Status": notion.DBPropTypeStatus,
+		"Tags":   notion.DBPropTypeMultiSelect,
+		"Date":   notion.DBPropTypeDate,
+	}}
+	props := notion.DatabasePageProperties{}
+	cleared := map[string]notion.DatabasePropertyType{}
+	cs.selectProperties(&db.Event{Properties: map[string]string{"Status": "Done"}}, props, cleared)
+
+	if got := props["Status"].Status; got == nil || got.Name != "Done" {
+		t.Errorf("status = %v, want Done", got)
+	}
+	if _, ok := props["Stage"]; ok {
+		t.Errorf("stage = %v, want none", props["Stage"])
+	}
+	want := map[string]notion.DatabasePropertyType{"Stage": notion.DBPropTypeSelect}
+	if !maps.Equal(cleared, want) {
+		t.Errorf("cleared = %v, want %v", cleared, want)
+	}
+}
@@ -0,0 +1,86 @@
+package notioncalendar
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"github.com/dstotijn/go-notion"
+)
+
+// loadSchema reads the tag options and property types of the database once
+func (cs *CalendarService) loadSchema(ctx context.Context) error {
+	cs.schemaMu.Lock()
+	defer cs.schemaMu.Unlock()
+	if cs.schemaLoaded {
+		return nil
+	}
+	var database notion.Database
+	err := cs.do(ctx, "notion find database", retry.Idempotent, func(ctx context.Context) error {
+		var err error
+		database, err = cs.client.FindDatabaseByID(ctx, cs.config.DatabaseID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("call api to find a database: %w", err)
+	}
+	for key, prop := range database.Properties {
+		cs.propertyTypes[key] = prop.Type
+		if key == cs.config.TagsPropertyName && prop.MultiSelect != nil {
+			for _, option := range prop.MultiSelect.Options {
+				cs.knownTags[option.Name] = option.Color
+			}
+		}
+	}
+	cs.schemaLoaded = true
+	return nil
+}
+
+// selectedName returns the selected option of a select or status property
+func selectedName(prop notion.DatabasePageProperty) string {
+	switch {
+	case prop.Select != nil:
+		return prop.Select.Name
+	case prop.Status != nil:
+		return prop.Status.Name
+	}
+	return ""
+}
+
+// selectProperties sets the select and status values of an event in props, and adds the select and status
+// properties of the schema that the event has no value for to cleared. The schema must be loaded beforehand.
+func (cs *CalendarService) selectProperties(event *db.Event, props notion.DatabasePageProperties, cleared map[string]notion.DatabasePropertyType) {
+	cs.schemaMu.Lock()
+	defer cs.schemaMu.Unlock()
+	for key, propType := range cs.propertyTypes {
+		if propType != notion.DBPropTypeSelect && propType != notion.DBPropTypeStatus {
+			continue
+		}
+		value, ok := event.Properties[key]
+		if !ok || value == "" {
+			cleared[key] = propType
+			continue
+		}
+		option := &notion.SelectOptions{Name: value}
+		if propType == notion.DBPropTypeSelect {
+			props[key] = notion.DatabasePageProperty{Select: option}
+		} else {
+			props[key] = notion.DatabasePageProperty{Status: option}
+		}
+	}
+}
+
+// tagsProperty sets the tags of a page in props, or adds the tags property to cleared if there are none,
+// so that the tags removed on Google Calendar are removed on Notion. The schema must be loaded beforehand.
+func (cs *CalendarService) tagsProperty(props notion.DatabasePageProperties, cleared map[string]notion.DatabasePropertyType, tags []notion.SelectOptions) {
+	if len(tags) > 0 {
+		props[cs.config.TagsPropertyName] = notion.DatabasePageProperty{MultiSelect: tags}
+		return
+	}
+	cs.schemaMu.Lock()
+	defer cs.schemaMu.Unlock()
+	if cs.propertyTypes[cs.config.TagsPropertyName] == notion.DBPropTypeMultiSelect {
+		cleared[cs.config.TagsPropertyName] = notion.DBPropTypeMultiSelect
+	}
+}
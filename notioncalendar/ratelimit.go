@@ -0,0 +1,53 @@
+package notioncalendar
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter is a token bucket shared by all requests to Notion, including those from concurrent workers
+type rateLimiter struct {
+	limiter *rate.Limiter
+	waited  atomic.Int64 // Total wait time in nanoseconds
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+	}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	start := time.Now()
+	err := l.limiter.Wait(ctx)
+	l.waited.Add(int64(time.Since(start)))
+	return err
+}
+
+// do sends a request through the rate limiter, retrying it if allowed by mode
+func (cs *CalendarService) do(ctx context.Context, name string, mode retry.Mode, fn func(ctx context.Context) error) (err error) {
+	ctx, span := telemetry.Start(ctx, name, attribute.String("provider", db.OriginNotion))
+	defer func() { telemetry.End(span, err) }()
+
+	return cs.retrier.Do(ctx, name, mode, func(ctx context.Context) error {
+		if err := cs.limiter.wait(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		err := fn(ctx)
+		cs.api.Observe(ctx, name, start, err)
+		return err
+	})
+}
+
+// RateLimitWait returns the total time spent waiting for the rate limiter
+func (cs *CalendarService) RateLimitWait() time.Duration {
+	return time.Duration(cs.limiter.waited.Load())
+}
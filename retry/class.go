@@ -0,0 +1,52 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dstotijn/go-notion"
+	"google.golang.org/api/googleapi"
+)
+
+// Classes of errors
+const (
+	// ClassTransient errors may go away if the operation is tried again in a later run
+	ClassTransient = "transient"
+	// ClassPermanent errors stay until something is changed, such as the configuration or the permissions
+	ClassPermanent = "permanent"
+	// ClassValidation errors come from an event that is malformed or rejected by a provider, until the event is fixed
+	ClassValidation = "validation"
+)
+
+// Classed is implemented by errors that know their class, such as the errors of the database
+type Classed interface {
+	error
+	ErrorClass() string
+}
+
+// Class returns the class of err, or an empty string if err is nil
+func Class(err error) string {
+	if err == nil {
+		return ""
+	}
+	var cErr Classed
+	if errors.As(err, &cErr) {
+		return cErr.ErrorClass()
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusBadRequest {
+		return ClassValidation
+	}
+	if errors.Is(err, notion.ErrValidation) || errors.Is(err, notion.ErrInvalidRequest) || errors.Is(err, notion.ErrInvalidJSON) {
+		return ClassValidation
+	}
+	// Exhausted retries are wrapped around the transient error
+	if retryable, _, _ := classify(err); retryable {
+		return ClassTransient
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassTransient
+	}
+	return ClassPermanent
+}
@@ -0,0 +1,171 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caarlos0/env/v9"
+	"github.com/dstotijn/go-notion"
+	"golang.org/x/exp/slog"
+	"google.golang.org/api/googleapi"
+)
+
+type Config struct {
+	MaxAttempts     int           `env:"RETRY_MAX_ATTEMPTS" envDefault:"5"`
+	InitialInterval time.Duration `env:"RETRY_INITIAL_INTERVAL" envDefault:"1s"`
+	MaxInterval     time.Duration `env:"RETRY_MAX_INTERVAL" envDefault:"30s"`
+	// Budget is the total number of retries allowed in a run
+	Budget int `env:"RETRY_BUDGET" envDefault:"30"`
+}
+
+// Mode tells whether an operation can be repeated safely
+type Mode int
+
+const (
+	// Idempotent operations are retried on any transient error
+	Idempotent Mode = iota
+	// NotIdempotent operations are retried only when the request was surely not applied
+	NotIdempotent
+)
+
+// Retrier retries operations that failed with a transient error, sharing a retry budget across a run
+type Retrier struct {
+	config    Config
+	mu        sync.Mutex
+	remaining int
+}
+
+func NewRetrier() (*Retrier, error) {
+	cfg := Config{}
+	if err := env.Parse(&cfg); err != nil {
+		return nil, fmt.Errorf("parse env: %w", err)
+	}
+	r := &Retrier{
+		config:    cfg,
+		remaining: cfg.Budget,
+	}
+	return r, nil
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, or runs out of attempts or budget
+func (r *Retrier) Do(ctx context.Context, name string, mode Mode, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		h := &hint{}
+		err := fn(context.WithValue(ctx, hintKey{}, h))
+		if err == nil {
+			return nil
+		}
+
+		retryable, rejected, after := classify(err)
+		if !retryable || (mode == NotIdempotent && !rejected) {
+			return err
+		}
+		if attempt >= r.config.MaxAttempts {
+			return fmt.Errorf("give up after %d attempts: %w", attempt, err)
+		}
+		if !r.take() {
+			return fmt.Errorf("retry budget exhausted: %w", err)
+		}
+
+		if h.after > after {
+			after = h.after
+		}
+		wait := r.backoff(attempt)
+		if after > 0 {
+			wait = after + wait/4
+		}
+		slog.Warn("retry", "operation", name, "attempt", attempt, "wait", wait, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("wait for retry: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// take consumes one retry from the budget
+func (r *Retrier) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remaining <= 0 {
+		return false
+	}
+	r.remaining--
+	return true
+}
+
+// backoff returns an exponential backoff with full jitter
+func (r *Retrier) backoff(attempt int) time.Duration {
+	d := r.config.InitialInterval << (attempt - 1)
+	if d <= 0 || d > r.config.MaxInterval {
+		d = r.config.MaxInterval
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// classify reports whether err is transient, whether the request was rejected without being applied,
+// and how long the server asked to wait
+func classify(err error) (retryable bool, rejected bool, after time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, false, 0
+	}
+
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		after = parseRetryAfter(gErr.Header.Get("Retry-After"))
+		switch {
+		case gErr.Code == http.StatusTooManyRequests:
+			return true, true, after
+		case gErr.Code == http.StatusForbidden:
+			for _, item := range gErr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true, true, after
+				}
+			}
+			return false, false, 0
+		case gErr.Code >= 500:
+			return true, false, after
+		}
+		return false, false, 0
+	}
+
+	var nErr *notion.APIError
+	if errors.As(err, &nErr) {
+		switch {
+		case nErr.Status == http.StatusTooManyRequests:
+			return true, true, 0
+		case nErr.Status >= 500 || errors.Is(err, notion.ErrConflict):
+			return true, false, 0
+		}
+		return false, false, 0
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, false, 0
+	}
+	return false, false, 0
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
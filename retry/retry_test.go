@@ -0,0 +1,173 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/go-notion"
+	"google.golang.org/api/googleapi"
+)
+
+func googleError(code int, header http.Header, reasons ...string) error {
+	gErr := &googleapi.Error{Code: code, Header: header}
+	for _, reason := range reasons {
+		gErr.Errors = append(gErr.Errors, googleapi.ErrorItem{Reason: reason})
+	}
+	return fmt.Errorf("call api: %w", gErr)
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantRetryable bool
+		wantRejected  bool
+		wantAfter     time.Duration
+	}{
+		{"google rate limit", googleError(http.StatusTooManyRequests, http.Header{"Retry-After": {"3"}}), true, true, 3 * time.Second},
+		{"google user rate limit", googleError(http.StatusForbidden, nil, "userRateLimitExceeded"), true, true, 0},
+		{"google forbidden", googleError(http.StatusForbidden, nil, "forbidden"), false, false, 0},
+		{"google server error", googleError(http.StatusServiceUnavailable, nil), true, false, 0},
+		{"google not found", googleError(http.StatusNotFound, nil), false, false, 0},
+		{"notion rate limit", &notion.APIError{Status: http.StatusTooManyRequests, Code: "rate_limited"}, true, true, 0},
+		{"notion conflict", &notion.APIError{Status: http.StatusConflict, Code: "conflict_error"}, true, false, 0},
+		{"notion server error", &notion.APIError{Status: http.StatusBadGateway}, true, false, 0},
+		{"notion validation", &notion.APIError{Status: http.StatusBadRequest, Code: "validation_error"}, false, false, 0},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, false, 0},
+		{"canceled", fmt.Errorf("call api: %w", context.Canceled), false, false, 0},
+		{"other", errors.New("invalid"), false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, rejected, after := classify(tt.err)
+			if retryable != tt.wantRetryable || rejected != tt.wantRejected || after != tt.wantAfter {
+				t.Errorf("classify() = %v, %v, %v, want %v, %v, %v", retryable, rejected, after, tt.wantRetryable, tt.wantRejected, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter(""); got != 0 {
+		t.Errorf("parseRetryAfter(\"\") = %v, want 0", got)
+	}
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(\"120\") = %v, want 2m", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("parseRetryAfter(\"soon\") = %v, want 0", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 1m", date, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := &Retrier{config: Config{InitialInterval: time.Second, MaxInterval: 5 * time.Second}}
+	for attempt, limit := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 64: 5 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := r.backoff(attempt); d < 0 || d > limit {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, limit)
+			}
+		}
+	}
+}
+
+func newTestRetrier(maxAttempts int, budget int) *Retrier {
+	return &Retrier{
+		config:    Config{MaxAttempts: maxAttempts, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Budget: budget},
+		remaining: budget,
+	}
+}
+
+// failing returns a function failing with errs in turn and then succeeding, and the number of calls
+func failing(errs ...error) (func(ctx context.Context) error, *int) {
+	calls := 0
+	return func(ctx context.Context) error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestDo(t *testing.T) {
+	unavailable := googleError(http.StatusServiceUnavailable, nil)
+	rateLimited := googleError(http.StatusTooManyRequests, nil)
+	notFound := googleError(http.StatusNotFound, nil)
+
+	tests := []struct {
+		name      string
+		mode      Mode
+		errs      []error
+		wantCalls int
+		wantErr   string
+	}{
+		{name: "success", mode: Idempotent, wantCalls: 1},
+		{name: "transient errors", mode: Idempotent, errs: []error{unavailable, unavailable}, wantCalls: 3},
+		{name: "permanent error", mode: Idempotent, errs: []error{notFound}, wantCalls: 1, wantErr: "404"},
+		{name: "not idempotent after a server error", mode: NotIdempotent, errs: []error{unavailable}, wantCalls: 1, wantErr: "503"},
+		{name: "not idempotent after a rate limit", mode: NotIdempotent, errs: []error{rateLimited}, wantCalls: 2},
+		{name: "attempts exhausted", mode: Idempotent, errs: []error{unavailable, unavailable, unavailable, unavailable}, wantCalls: 3, wantErr: "give up after 3 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRetrier(3, 10)
+			fn, calls := failing(tt.errs...)
+			err := r.Do(context.Background(), "test", tt.mode, fn)
+			if *calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", *calls, tt.wantCalls)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Do() error = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Do() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoBudget(t *testing.T) {
+	unavailable := googleError(http.StatusServiceUnavailable, nil)
+	r := newTestRetrier(5, 3)
+
+	// The budget is shared by the operations of a run
+	fn, calls := failing(unavailable, unavailable)
+	if err := r.Do(context.Background(), "first", Idempotent, fn); err != nil {
+		t.Fatalf("Do() error = %v, want nil", err)
+	}
+	fn, calls = failing(unavailable, unavailable)
+	err := r.Do(context.Background(), "second", Idempotent, fn)
+	if err == nil || !strings.Contains(err.Error(), "retry budget exhausted") {
+		t.Errorf("Do() error = %v, want the budget exhausted", err)
+	}
+	if *calls != 2 {
+		t.Errorf("calls = %d, want 2", *calls)
+	}
+	if !errors.Is(err, unavailable) {
+		t.Errorf("Do() error = %v, want the last error wrapped", err)
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	r := newTestRetrier(5, 10)
+	r.config.InitialInterval, r.config.MaxInterval = time.Hour, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	fn := func(ctx context.Context) error {
+		cancel()
+		return googleError(http.StatusServiceUnavailable, nil)
+	}
+	err := r.Do(ctx, "test", Idempotent, fn)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,34 @@
+package retry
+
+import (
+	"net/http"
+	"time"
+)
+
+type hintKey struct{}
+
+// hint carries the Retry-After header of a response back to Retrier.Do
+// for clients whose errors do not expose response headers
+type hint struct {
+	after time.Duration
+}
+
+// Transport records the Retry-After header of responses to requests made within Retrier.Do
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := req.Context().Value(hintKey{}).(*hint); ok {
+		h.after = parseRetryAfter(res.Header.Get("Retry-After"))
+	}
+	return res, nil
+}
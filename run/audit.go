@@ -0,0 +1,168 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+)
+
+// audit writes the record of a run and its operations to the database
+type audit struct {
+	record     *db.RunRecord
+	operations atomic.Int64
+}
+
+// beginRun takes the run lock and starts recording the operations of a run in the audit log.
+// The returned context is cancelled if the lock is lost. It fails with ErrAlreadyRunning if another run holds the lock.
+func (s *services) beginRun(ctx context.Context, command string, trigger string) (context.Context, error) {
+	if trigger == "" {
+		trigger = db.TriggerCLI
+	}
+	now := time.Now()
+	record := &db.RunRecord{
+		ID:        uuid.NewString(),
+		Command:   command,
+		Trigger:   trigger,
+		StartedAt: now,
+		ExpiresAt: now.Add(s.config.AuditRetention),
+	}
+	ctx, err := s.lock(ctx, record.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.audit = &audit{record: record}
+	slog.Info("begin run", "run_id", record.ID, "command", command, "trigger", trigger)
+	err = s.database.SetRunRecord(ctx, record)
+	if err != nil {
+		s.unlock()
+		return nil, fmt.Errorf("record run start: %w", err)
+	}
+	return ctx, nil
+}
+
+// endRun records the end of a run and its error, and releases the run lock
+func (s *services) endRun(ctx context.Context, runErr error) {
+	defer s.unlock()
+	if ctx.Err() != nil { // Cancelled when the run lock is lost
+		ctx = context.Background()
+	}
+	record := s.audit.record
+	record.EndedAt = time.Now()
+	record.Operations = int(s.audit.operations.Load())
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+	s.metrics.run(ctx, record.Command, record.StartedAt, record.EndedAt, runErr)
+	wait := s.notion.RateLimitWait()
+	s.metrics.rateLimitWait(ctx, record.Command, wait)
+	s.report.count("notion_rate_limit_wait_ms", int(wait.Milliseconds()))
+	err := s.database.SetRunRecord(ctx, record)
+	if err != nil {
+		slog.Error("record run end", "run_id", record.ID, "error", err)
+	}
+	if record.Command == "sync" && runErr == nil {
+		err := s.database.SetLastSuccess(ctx, &db.SyncStatus{RunID: record.ID, EndedAt: record.EndedAt})
+		if err != nil {
+			slog.Error("record last success", "run_id", record.ID, "error", err)
+		}
+	}
+}
+
+// record writes an operation to the audit log. The audit log is not allowed to fail the operation.
+func (s *services) record(ctx context.Context, side string, action string, before *db.Event, after *db.Event, opErr error) {
+	s.metrics.operation(ctx, side, action, opErr)
+	if s.audit == nil {
+		return
+	}
+	operation := &db.Operation{
+		RunID:     s.audit.record.ID,
+		Side:      side,
+		Action:    action,
+		Changes:   []db.Change{},
+		At:        time.Now(),
+		ExpiresAt: s.audit.record.ExpiresAt,
+	}
+	// Snapshots, since the events are modified by later steps
+	if before != nil {
+		operation.Before = cloneEvent(before)
+		operation.UUID = before.UUID
+	}
+	if after != nil {
+		operation.After = cloneEvent(after)
+		operation.UUID = after.UUID
+	}
+	if before != nil && after != nil {
+		if before.UUID != after.UUID {
+			operation.Changes = append(operation.Changes, db.Change{Field: "uuid", Before: before.UUID, After: after.UUID})
+		}
+		for _, f := range eventFields(before, after) {
+			if !f.equal(before, after) {
+				operation.Changes = append(operation.Changes, db.Change{Field: f.name, Before: f.format(before), After: f.format(after)})
+			}
+		}
+	}
+	if opErr != nil {
+		operation.Error = opErr.Error()
+	}
+
+	s.audit.operations.Add(1)
+	err := s.database.AddOperation(ctx, operation)
+	if err != nil {
+		slog.Error("record operation", "run_id", operation.RunID, "uuid", operation.UUID, "error", err)
+	}
+}
+
+// HistoryQuery selects the entries of the audit log
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	UUID  string // Operations on an event in [From, To)
+	RunID string // Operations of a run, regardless of the period
+}
+
+// History returns the runs started in [From, To), or the operations selected by the query
+func History(q HistoryQuery) ([]*db.RunRecord, []*db.Operation, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+
+	switch {
+	case q.RunID != "":
+		record, err := s.database.GetRunRecord(ctx, q.RunID)
+		if err != nil {
+			return nil, nil, err
+		}
+		operations, err := s.database.ListOperations(ctx, "run_id", q.RunID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*db.RunRecord{record}, operations, nil
+	case q.UUID != "":
+		operations, err := s.database.ListOperations(ctx, "uuid", q.UUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		filtered := []*db.Operation{}
+		for _, operation := range operations {
+			if !operation.At.Before(q.From) && operation.At.Before(q.To) {
+				filtered = append(filtered, operation)
+			}
+		}
+		return nil, filtered, nil
+	}
+
+	records, err := s.database.ListRunRecords(ctx, q.From, q.To)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, nil, nil
+}
@@ -2,136 +2,260 @@ package run
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
-	"github.com/Kitsuya0828/notion-google-calendar-sync/googlecalendar"
-	"github.com/Kitsuya0828/notion-google-calendar-sync/notioncalendar"
 	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
-func checkAdd(
+func (s *services) checkAdd(
 	ctx context.Context,
-	notionCalendarService *notioncalendar.CalendarService,
-	googleCalendarService *googlecalendar.CalendarService,
 	notionEvents []*db.Event,
 	googleCalendarEvents []*db.Event,
-	databaseService *db.DatabaseService,
+	journaled map[string]bool,
+	skip held,
 ) error {
 	events := append(notionEvents, googleCalendarEvents...)
+	tasks := []task{}
 	for _, event := range events {
-		if event.UUID == "" { // Not yet added to the database
-			uuid, err := uuid.NewRandom()
-			if err != nil {
-				return fmt.Errorf("randomly generate a UUID: %v", err)
-			}
-			event.UUID = uuid.String()
+		if event.UUID != "" { // Already added to the database
+			continue
+		}
+		if skip.has(event) { // Dead letter
+			continue
+		}
+		if journaled[event.NotionEventID] || journaled[event.GoogleCalendarEventID] { // Handled by the journal
+			continue
+		}
+		event := event
+		id := event.NotionEventID
+		if id == "" {
+			id = event.GoogleCalendarEventID
+		}
+		tasks = append(tasks, task{id: id, fn: func(ctx context.Context) error {
+			s.failures.attempt(event)
+			err := s.addEvent(ctx, event)
+			s.reportResult(event, OutcomeCreated, err)
+			return err
+		}})
+	}
+	return s.exec.run(ctx, tasks)
+}
 
-			if event.NotionEventID == "" { // Not yet added to Notion
-				notionEventID, err := notionCalendarService.CreateEvent(ctx, event)
-				if err != nil {
-					return fmt.Errorf("create notion event for newly added google calendar event: %v", err)
-				}
-				event.NotionEventID = notionEventID
-				err = googleCalendarService.UpdateEvent(event)
-				if err != nil {
-					return fmt.Errorf("update uuid for newly added google calendar event: %v", err)
-				}
-			} else if event.GoogleCalendarEventID == "" { // // Not yet added to Google Calendar
-				googleCalendarEventID, err := googleCalendarService.InsertEvent(event)
-				if err != nil {
-					return fmt.Errorf("create google calendar event for newly added notion event: %v", err)
-				}
-				event.GoogleCalendarEventID = googleCalendarEventID
-				err = notionCalendarService.UpdateEvent(ctx, event)
-				if err != nil {
-					return fmt.Errorf("update uuid for newly added notion event: %v", err)
-				}
-			}
+// addEvent records the creation of a newly added event in the journal and performs it
+func (s *services) addEvent(
+	ctx context.Context,
+	event *db.Event,
+) error {
+	uuid, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("randomly generate a UUID: %w", err)
+	}
+	event.UUID = uuid.String()
 
-			err = databaseService.AddEvent(ctx, event)
-			if err != nil {
-				return fmt.Errorf("add a newly added event to db: %v", err)
-			}
-		}
+	entry := &db.JournalEntry{
+		UUID:      event.UUID,
+		Origin:    db.OriginGoogleCalendar,
+		Event:     event,
+		CreatedAt: time.Now(),
 	}
-	return nil
+	if event.NotionEventID != "" {
+		entry.Origin = db.OriginNotion
+	}
+	err = s.database.SetJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("record newly added event in journal: %w", err)
+	}
+	return s.completeAdd(ctx, entry, false)
 }
 
-func checkUpdate(
+func (s *services) checkUpdate(
 	ctx context.Context,
-	notionCalendarService *notioncalendar.CalendarService,
-	googleCalendarService *googlecalendar.CalendarService,
 	notionEvents []*db.Event,
 	googleCalendarEvents []*db.Event,
-	databaseService *db.DatabaseService,
+	skip held,
 ) error {
-	events, err := databaseService.ListEvents(ctx)
+	events, err := s.database.ListEvents(ctx)
 	if err != nil {
-		return fmt.Errorf("list db events before checking update: %v", err)
+		return fmt.Errorf("list db events before checking update: %w", err)
+	}
+	// Events that cannot be read on a side would be taken for deleted ones
+	events = slices.DeleteFunc(events, skip.has)
+	notionEventsIDMap := getEventsIDMap(notionEvents)
+	googleCalendarEventsIDMap := getEventsIDMap(googleCalendarEvents)
+	err = s.checkDeletions(events, notionEventsIDMap, googleCalendarEventsIDMap)
+	if err != nil {
+		return err
 	}
-	for _, event := range events {
-		isNotionDeleted := false
-		notionEventsIDMap := getEventsIDMap(notionEvents)
-		// Check if the event has been deleted on Notion
-		notionEvent, ok := notionEventsIDMap[event.UUID]
-		if !ok {
-			isNotionDeleted = true
-		}
 
-		isGoogleCalendarDeleted := false
-		googleCalendarEventsIDMap := getEventsIDMap(googleCalendarEvents)
-		// Check if the event has been deleted on Google Calendar
-		googelCalendarEvent, ok := googleCalendarEventsIDMap[event.UUID]
-		if !ok {
-			isGoogleCalendarDeleted = true
-		}
+	conflicts, err := s.database.ListQueuedConflicts(ctx)
+	if err != nil {
+		return fmt.Errorf("list queued conflicts before checking update: %w", err)
+	}
+	queued := map[string][]*db.Conflict{}
+	for _, conflict := range conflicts {
+		queued[conflict.UUID] = append(queued[conflict.UUID], conflict)
+	}
 
-		// If the event is deleted either on Notion or Google Calendar
-		// TODO: Maintain consistency of events
-		if isNotionDeleted && !isGoogleCalendarDeleted {
-			err := googleCalendarService.DeleteEvent(event)
-			if err != nil {
-				return fmt.Errorf("delete google calendar event for deleted notion event: %v", err)
-			}
-			err = databaseService.DeleteEvent(ctx, event)
-			if err != nil {
-				return fmt.Errorf("delete db event for deleted notion event: %v", err)
-			}
-			continue
-		} else if !isNotionDeleted && isGoogleCalendarDeleted {
-			err := notionCalendarService.DeleteEvent(ctx, event)
-			if err != nil {
-				return fmt.Errorf("delete notion event for deleted google calendar event: %v", err)
-			}
-			err = databaseService.DeleteEvent(ctx, event)
+	tasks := []task{}
+	for _, event := range events {
+		event := event
+		tasks = append(tasks, task{uuid: event.UUID, fn: func(ctx context.Context) error {
+			s.failures.attempt(event)
+			err := s.updateEvent(ctx, event, notionEventsIDMap, googleCalendarEventsIDMap, queued[event.UUID])
 			if err != nil {
-				return fmt.Errorf("delete db event for deleted google calendar event: %v", err)
+				s.reportResult(event, OutcomeFailed, err)
 			}
-			continue
+			return err
+		}})
+	}
+	return s.exec.run(ctx, tasks)
+}
+
+func (s *services) updateEvent(
+	ctx context.Context,
+	event *db.Event,
+	notionEventsIDMap map[string]*db.Event,
+	googleCalendarEventsIDMap map[string]*db.Event,
+	queued []*db.Conflict,
+) error {
+	isNotionDeleted := false
+	// Check if the event has been deleted on Notion
+	notionEvent, ok := notionEventsIDMap[event.UUID]
+	if !ok {
+		isNotionDeleted = true
+	}
+
+	isGoogleCalendarDeleted := false
+	// Check if the event has been deleted on Google Calendar
+	googelCalendarEvent, ok := googleCalendarEventsIDMap[event.UUID]
+	if !ok {
+		isGoogleCalendarDeleted = true
+	}
+
+	if isNotionDeleted && isGoogleCalendarDeleted { // Passed, or deleted on both sides
+		return nil
+	}
+
+	// If the event is deleted either on Notion or Google Calendar
+	// TODO: Maintain consistency of events
+	if isNotionDeleted && !isGoogleCalendarDeleted {
+		err := s.exec.callGoogle(ctx, func() error {
+			return s.google.DeleteEvent(ctx, event)
+		})
+		s.record(ctx, db.OriginGoogleCalendar, db.ActionDelete, googelCalendarEvent, nil, err)
+		if err != nil {
+			return fmt.Errorf("delete google calendar event for deleted notion event: %w", err)
+		}
+		before := cloneEvent(event)
+		err = s.bury(ctx, updateEventField(event, googelCalendarEvent), db.OriginNotion)
+		s.record(ctx, db.SideDB, db.ActionDelete, before, nil, err)
+		if err != nil {
+			return fmt.Errorf("bury db event for deleted notion event: %w", err)
+		}
+		err = s.dropConflicts(ctx, queued)
+		if err != nil {
+			return err
+		}
+		s.report.event(event, OutcomeDeleted, "deleted on notion")
+		return nil
+	} else if !isNotionDeleted && isGoogleCalendarDeleted {
+		err := s.exec.callNotion(ctx, func() error {
+			return s.notion.DeleteEvent(ctx, event)
+		})
+		s.record(ctx, db.OriginNotion, db.ActionDelete, notionEvent, nil, err)
+		if err != nil {
+			return fmt.Errorf("delete notion event for deleted google calendar event: %w", err)
 		}
+		before := cloneEvent(event)
+		err = s.bury(ctx, updateEventField(event, notionEvent), db.OriginGoogleCalendar)
+		s.record(ctx, db.SideDB, db.ActionDelete, before, nil, err)
+		if err != nil {
+			return fmt.Errorf("bury db event for deleted google calendar event: %w", err)
+		}
+		err = s.dropConflicts(ctx, queued)
+		if err != nil {
+			return err
+		}
+		s.report.event(event, OutcomeDeleted, "deleted on google calendar")
+		return nil
+	}
 
-		correctEvent, isNotionUpdated, isGoogleCalendarUpdated := getCorrectEvent(event, notionEvent, googelCalendarEvent)
-		slog.Debug("check update", "notion", isNotionUpdated, "google calendar", isGoogleCalendarUpdated, "uuid", event.UUID)
-		if isNotionUpdated || isGoogleCalendarUpdated {
-			err := databaseService.SetEvent(ctx, correctEvent)
-			if err != nil {
-				return fmt.Errorf("set correct event to db while checking update: %v", err)
-			}
-			if isNotionUpdated {
-				err := googleCalendarService.UpdateEvent(correctEvent)
-				if err != nil {
-					return fmt.Errorf("set correct event to google calendar while checking update: %v", err)
-				}
-			}
-			if isGoogleCalendarUpdated {
-				err := notionCalendarService.UpdateEvent(ctx, correctEvent)
-				if err != nil {
-					return fmt.Errorf("set correct event to notion while checking update: %v", err)
-				}
-			}
+	// Conflicts left to the user stay unsynchronized until they are resolved
+	base := cloneEvent(event)
+	pending, resolved, err := s.resolveQueued(ctx, base, notionEvent, googelCalendarEvent, queued)
+	if err != nil {
+		return err
+	}
+	m := mergeEvent(base, notionEvent, googelCalendarEvent, func(field string) string {
+		if _, ok := pending[field]; ok {
+			return PolicyManual
+		}
+		return s.config.conflictPolicy(field)
+	})
+	err = s.queueConflicts(ctx, m, notionEvent, pending, resolved)
+	if err != nil {
+		return fmt.Errorf("queue conflicts while checking update: %w", err)
+	}
+	slog.Debug("check update", "notion", m.isNotionUpdated, "google calendar", m.isGoogleCalendarUpdated, "uuid", event.UUID)
+	if m.isNotionUpdated {
+		err := s.exec.callNotion(ctx, func() error {
+			return s.notion.UpdateEvent(ctx, m.notion)
+		})
+		s.record(ctx, db.OriginNotion, db.ActionUpdate, notionEvent, m.notion, err)
+		if err != nil {
+			return fmt.Errorf("set merged event to notion while checking update: %w", err)
+		}
+		// Record the tags selected on Notion on the other sides
+		if !m.isPending("color") {
+			m.event.Tags = m.notion.Tags
+			m.google.Tags = m.notion.Tags
+			m.isGoogleCalendarUpdated = !equalEvents(m.google, m.googleRead)
+		}
+	}
+	if m.isGoogleCalendarUpdated {
+		err := s.exec.callGoogle(ctx, func() error {
+			return s.google.UpdateEvent(ctx, m.google)
+		})
+		s.record(ctx, db.OriginGoogleCalendar, db.ActionUpdate, googelCalendarEvent, m.google, err)
+		if err != nil {
+			return fmt.Errorf("set merged event to google calendar while checking update: %w", err)
 		}
 	}
+	isDBUpdated := !equalEvents(m.event, event)
+	if isDBUpdated {
+		m.event, err = s.setEvent(ctx, event, m.event)
+		s.record(ctx, db.SideDB, db.ActionUpdate, event, m.event, err)
+		if err != nil {
+			return fmt.Errorf("set merged event to db while checking update: %w", err)
+		}
+	}
+
+	unresolved := []string{}
+	for _, conflict := range m.conflicts {
+		if conflict.Winner == "" {
+			unresolved = append(unresolved, conflict.Field)
+		}
+	}
+	switch {
+	case m.isNotionUpdated || m.isGoogleCalendarUpdated || isDBUpdated:
+		s.report.event(m.event, OutcomeUpdated, "")
+	case len(unresolved) > 0:
+		s.report.event(m.event, OutcomeSkipped, "waiting for a side to be picked for "+strings.Join(unresolved, ", "))
+	}
 	return nil
 }
+
+// joinInvalid joins the errors of the events that cannot be read
+func joinInvalid(invalid []*db.ValidationError) error {
+	errs := []error{}
+	for _, v := range invalid {
+		errs = append(errs, v)
+	}
+	return errors.Join(errs...)
+}
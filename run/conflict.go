@@ -0,0 +1,192 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// fieldByName returns the field merged under a name
+func fieldByName(name string) (field, bool) {
+	if property, ok := strings.CutPrefix(name, propertyFieldPrefix); ok {
+		return propertyField(property), true
+	}
+	i := slices.IndexFunc(fields, func(f field) bool { return f.name == name })
+	if i < 0 {
+		return field{}, false
+	}
+	return fields[i], true
+}
+
+// resolveQueued applies the queued conflicts of an event that have been resolved, by setting the value of the losing side
+// as the base of the merge so that the winning value is synchronized. It returns the conflicts still unresolved by field.
+// A conflict is resolved by the CLI, by unchecking the conflict flag on Notion (Notion wins),
+// or by making both sides equal. It also reports whether any conflict has been resolved.
+func (s *services) resolveQueued(
+	ctx context.Context,
+	base *db.Event,
+	notionEvent *db.Event,
+	googleCalendarEvent *db.Event,
+	queued []*db.Conflict,
+) (map[string]*db.Conflict, bool, error) {
+	pending := map[string]*db.Conflict{}
+	resolved := false
+	for _, conflict := range queued {
+		f, ok := fieldByName(conflict.Field)
+		if !ok {
+			slog.Warn("drop queued conflict on unknown field", "uuid", conflict.UUID, "field", conflict.Field)
+		}
+		winner := conflict.Winner
+		if ok && winner == "" && s.notion.FlagsConflicts() && !notionEvent.ConflictFlagged {
+			winner = db.OriginNotion
+		}
+		switch {
+		case !ok:
+		case winner == db.OriginNotion:
+			f.copy(base, googleCalendarEvent)
+		case winner == db.OriginGoogleCalendar:
+			f.copy(base, notionEvent)
+		case f.equal(notionEvent, googleCalendarEvent):
+		default:
+			pending[conflict.Field] = conflict
+			continue
+		}
+
+		err := s.database.DeleteQueuedConflict(ctx, conflict)
+		if err != nil {
+			return nil, false, fmt.Errorf("delete resolved conflict: %w", err)
+		}
+		slog.Info("resolved conflict", "uuid", conflict.UUID, "field", conflict.Field, "winner", winner)
+		resolved = true
+	}
+	return pending, resolved, nil
+}
+
+// queueConflicts records the new conflicts of a merge, queues those left to the user and flags them on Notion.
+// Queued conflicts not detected again have been resolved by editing one side back and are dropped.
+func (s *services) queueConflicts(
+	ctx context.Context,
+	m *merge,
+	notionEvent *db.Event,
+	pending map[string]*db.Conflict,
+	resolved bool,
+) error {
+	unresolved := []*db.Conflict{}
+	queue := []*db.Conflict{}
+	for _, conflict := range m.conflicts {
+		queued, ok := pending[conflict.Field]
+		delete(pending, conflict.Field)
+		if conflict.Winner == "" {
+			unresolved = append(unresolved, conflict)
+		}
+		if ok { // Already recorded
+			conflict.DetectedAt = queued.DetectedAt
+			if *conflict != *queued {
+				queue = append(queue, conflict)
+			}
+			continue
+		}
+		s.metrics.conflict(ctx, conflict.Field, conflict.Policy, conflict.Winner)
+		s.report.conflict(conflict)
+		err := s.database.AddConflict(ctx, conflict)
+		if err != nil {
+			return fmt.Errorf("record conflict: %w", err)
+		}
+		if conflict.Winner == "" {
+			queue = append(queue, conflict)
+		}
+	}
+	for _, conflict := range pending {
+		err := s.database.DeleteQueuedConflict(ctx, conflict)
+		if err != nil {
+			return fmt.Errorf("delete resolved conflict: %w", err)
+		}
+		slog.Info("resolved conflict", "uuid", conflict.UUID, "field", conflict.Field)
+		resolved = true
+	}
+
+	// The page is flagged before the conflicts are queued, so that an unchecked flag always means a choice of the user
+	if s.notion.FlagsConflicts() && (resolved || len(queue) > 0 || notionEvent.ConflictFlagged != (len(unresolved) > 0)) {
+		details := []string{}
+		for _, conflict := range unresolved {
+			details = append(details, conflict.Field+" on Google Calendar: "+conflict.GoogleCalendarValue)
+		}
+		err := s.exec.callNotion(ctx, func() error {
+			return s.notion.SetConflict(ctx, m.notion, strings.Join(details, "\n"))
+		})
+		if err != nil {
+			return fmt.Errorf("flag conflict on notion: %w", err)
+		}
+	}
+	for _, conflict := range queue {
+		err := s.database.SetQueuedConflict(ctx, conflict)
+		if err != nil {
+			return fmt.Errorf("queue conflict: %w", err)
+		}
+	}
+	return nil
+}
+
+// dropConflicts deletes the queued conflicts of a deleted event
+func (s *services) dropConflicts(ctx context.Context, queued []*db.Conflict) error {
+	for _, conflict := range queued {
+		err := s.database.DeleteQueuedConflict(ctx, conflict)
+		if err != nil {
+			return fmt.Errorf("delete conflict of deleted event: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListConflicts returns the conflicts waiting for the user to pick a side
+func ListConflicts() ([]*db.Conflict, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.database.ListQueuedConflicts(ctx)
+}
+
+// ResolveConflict picks the winning side of the queued conflicts of an event, on a field or on all fields if field is empty.
+// The choice is applied to both sides on the next run.
+func ResolveConflict(uuid string, winner string, field string) ([]*db.Conflict, error) {
+	if winner != db.OriginNotion && winner != db.OriginGoogleCalendar {
+		return nil, fmt.Errorf("unknown side %q", winner)
+	}
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	conflicts, err := s.database.ListQueuedConflicts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resolved := []*db.Conflict{}
+	for _, conflict := range conflicts {
+		if conflict.UUID != uuid || (field != "" && conflict.Field != field) {
+			continue
+		}
+		conflict.Winner = winner
+		err := s.database.SetQueuedConflict(ctx, conflict)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, conflict)
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("no conflict queued for %s", uuid)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,207 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"golang.org/x/exp/slices"
+)
+
+// held are the events left out of a run, by UUID and by ID on each side
+type held map[string]bool
+
+func (h held) add(ids ...string) {
+	for _, id := range ids {
+		if id != "" {
+			h[id] = true
+		}
+	}
+}
+
+func (h held) has(event *db.Event) bool {
+	return h[event.UUID] || h[event.NotionEventID] || h[event.GoogleCalendarEventID]
+}
+
+// newHeld holds the dead letters and the events that cannot be read
+func newHeld(deadLetters []*db.FailedEvent, invalid []*db.ValidationError) held {
+	h := held{}
+	for _, d := range deadLetters {
+		h.add(d.UUID, d.ID)
+	}
+	for _, v := range invalid {
+		h.add(v.UUID, v.ID)
+	}
+	return h
+}
+
+// failures collects the events attempted and failing in a run
+type failures struct {
+	mu        sync.Mutex
+	attempted map[string]bool
+	events    map[string]*db.FailedEvent
+}
+
+func newFailures() *failures {
+	return &failures{attempted: map[string]bool{}, events: map[string]*db.FailedEvent{}}
+}
+
+// failureKey identifies an event among the failed events, by UUID or else by its ID on its side
+func failureKey(event *db.Event) (key string, side string, id string) {
+	if event.UUID != "" {
+		return event.UUID, "", ""
+	}
+	side, id = db.OriginNotion, event.NotionEventID
+	if id == "" {
+		side, id = db.OriginGoogleCalendar, event.GoogleCalendarEventID
+	}
+	return side + "_" + id, side, id
+}
+
+// attempt records that an event is processed by the run, so that its failure count is reset unless it fails.
+// It does nothing on nil.
+func (f *failures) attempt(event *db.Event) {
+	if f == nil {
+		return
+	}
+	key, _, _ := failureKey(event)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempted[key] = true
+}
+
+// add records the failure of an event. It does nothing on nil, so that the commands other than sync need none.
+func (f *failures) add(event *db.Event, err error) {
+	if f == nil {
+		return
+	}
+	now := time.Now()
+	key, side, id := failureKey(event)
+	failed := &db.FailedEvent{
+		Key:           key,
+		UUID:          event.UUID,
+		Side:          side,
+		ID:            id,
+		Title:         event.Title,
+		Failures:      1,
+		Error:         err.Error(),
+		Class:         retry.Class(err),
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events[failed.Key] = failed
+}
+
+// trackFailures counts the runs in a row in which each event failed, and moves the events failing in
+// SYNC_DEAD_LETTER_AFTER runs in a row to the dead letters. Transient failures neither count nor reset the count,
+// and neither do the runs that did not attempt the event.
+func (s *services) trackFailures(ctx context.Context) error {
+	if s.config.DeadLetterAfter <= 0 {
+		return nil
+	}
+	tracked, err := s.database.ListFailedEvents(ctx)
+	if err != nil {
+		return fmt.Errorf("list failed events: %w", err)
+	}
+	previous := map[string]*db.FailedEvent{}
+	for _, failed := range tracked {
+		previous[failed.Key] = failed
+	}
+
+	errs := []error{}
+	for key, failed := range s.failures.events {
+		if failed.Class == retry.ClassTransient {
+			delete(previous, key)
+			continue
+		}
+		if prev, ok := previous[key]; ok {
+			failed.Failures = prev.Failures + 1
+			failed.FirstFailedAt = prev.FirstFailedAt
+			delete(previous, key)
+		}
+		if failed.Failures < s.config.DeadLetterAfter {
+			errs = append(errs, s.database.SetFailedEvent(ctx, failed))
+			continue
+		}
+		err := s.database.KillFailedEvent(ctx, failed)
+		if err == nil {
+			s.report.deadLetter(failed)
+		}
+		errs = append(errs, err)
+	}
+	// The other events attempted in this run succeeded or were left unchanged.
+	// Those not attempted, for example because the run stopped early, keep their count.
+	for key := range previous {
+		if s.failures.attempted[key] {
+			errs = append(errs, s.database.DeleteFailedEvent(ctx, key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListDeadLetters returns the events left out of the runs after failing repeatedly, and the discarded ones if all is true
+func ListDeadLetters(all bool) ([]*db.FailedEvent, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	deadLetters, err := s.database.ListDeadLetters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !all {
+		deadLetters = slices.DeleteFunc(deadLetters, func(d *db.FailedEvent) bool { return d.Discarded })
+	}
+	return deadLetters, nil
+}
+
+// RetryDeadLetter takes an event out of the dead letters, so that the next run processes it again
+func RetryDeadLetter(key string) (*db.FailedEvent, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	failed, err := s.database.GetDeadLetter(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.database.DeleteDeadLetter(ctx, key); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// DiscardDeadLetter leaves an event of the dead letters out of the runs for good, until it is retried
+func DiscardDeadLetter(key string) (*db.FailedEvent, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	failed, err := s.database.GetDeadLetter(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	failed.Discarded = true
+	if err := s.database.SetDeadLetter(ctx, failed); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
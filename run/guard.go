@@ -0,0 +1,51 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slog"
+)
+
+// ErrMassDeletion is returned when a run would delete more events than allowed
+var ErrMassDeletion = errors.New("too many deletions")
+
+// checkDeletions aborts the run if too many events are missing from one side,
+// which usually means that a listing was wrong rather than that the events were deleted
+func (s *services) checkDeletions(events []*db.Event, notionEventsIDMap map[string]*db.Event, googleCalendarEventsIDMap map[string]*db.Event) error {
+	tracked := 0
+	deletions := []*db.Event{}
+	for _, event := range events {
+		_, onNotion := notionEventsIDMap[event.UUID]
+		_, onGoogleCalendar := googleCalendarEventsIDMap[event.UUID]
+		if !onNotion && !onGoogleCalendar { // Passed, or deleted on both sides
+			continue
+		}
+		tracked++
+		if onNotion != onGoogleCalendar {
+			deletions = append(deletions, event)
+		}
+	}
+	if len(deletions) == 0 {
+		return nil
+	}
+
+	exceedsCount := s.config.MaxDeletions > 0 && len(deletions) > s.config.MaxDeletions
+	exceedsPercent := s.config.MaxDeletionPercent > 0 && float64(len(deletions))*100 > s.config.MaxDeletionPercent*float64(tracked)
+	if !exceedsCount && !exceedsPercent {
+		return nil
+	}
+	for _, event := range deletions {
+		side := db.OriginNotion
+		if _, onNotion := notionEventsIDMap[event.UUID]; onNotion {
+			side = db.OriginGoogleCalendar
+		}
+		slog.Warn("would delete event", "uuid", event.UUID, "title", event.Title, "missing on", side)
+	}
+	if s.config.AllowMassDeletion {
+		slog.Warn("mass deletion allowed", "deletions", len(deletions), "tracked", tracked)
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d tracked events would be deleted, allow mass deletion to proceed", ErrMassDeletion, len(deletions), tracked)
+}
@@ -0,0 +1,58 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+)
+
+func TestCheckDeletions(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxCount   int
+		maxPercent float64
+		allow      bool
+		deleted    int // Of 10 tracked events
+		passed     int // Missing on both sides, which are not tracked
+		wantErr    bool
+	}{
+		{name: "no deletion", maxCount: 1, maxPercent: 1},
+		{name: "count at the threshold", maxCount: 3, deleted: 3},
+		{name: "count over the threshold", maxCount: 3, deleted: 4, wantErr: true},
+		{name: "percent at the threshold", maxPercent: 30, deleted: 3},
+		{name: "percent over the threshold", maxPercent: 30, deleted: 4, wantErr: true},
+		{name: "passed events not tracked", maxPercent: 30, deleted: 4, passed: 10, wantErr: true},
+		{name: "either threshold", maxCount: 10, maxPercent: 20, deleted: 3, wantErr: true},
+		{name: "thresholds disabled", deleted: 10},
+		{name: "mass deletion allowed", maxCount: 1, allow: true, deleted: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &services{config: Config{MaxDeletions: tt.maxCount, MaxDeletionPercent: tt.maxPercent, AllowMassDeletion: tt.allow}}
+			events := []*db.Event{}
+			notionEvents := map[string]*db.Event{}
+			googleCalendarEvents := map[string]*db.Event{}
+			for i := 0; i < 10; i++ {
+				event := &db.Event{UUID: fmt.Sprintf("uuid-%d", i)}
+				events = append(events, event)
+				notionEvents[event.UUID] = event
+				if i >= tt.deleted {
+					googleCalendarEvents[event.UUID] = event
+				}
+			}
+			for i := 0; i < tt.passed; i++ {
+				events = append(events, &db.Event{UUID: fmt.Sprintf("passed-%d", i)})
+			}
+
+			err := s.checkDeletions(events, notionEvents, googleCalendarEvents)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("checkDeletions() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrMassDeletion) {
+				t.Errorf("checkDeletions() error = %v, want %v", err, ErrMassDeletion)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// checkTimeout bounds each check of a dependency, so that a probe answers before it times out
+const checkTimeout = 5 * time.Second
+
+// Health answers the probes of the daemon, sharing the clients between the probes
+type Health struct {
+	s         *services
+	startedAt time.Time
+}
+
+// HealthStatus is the result of a probe
+type HealthStatus struct {
+	OK               bool              `json:"ok"`
+	LastSuccess      *time.Time        `json:"last_success,omitempty"` // Nil if no sync has ever succeeded
+	LastSuccessRunID string            `json:"last_success_run_id,omitempty"`
+	Checks           map[string]string `json:"checks"` // "ok" or the error, by check
+}
+
+func NewHealth(ctx context.Context) (*Health, error) {
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Health{s: s, startedAt: time.Now()}, nil
+}
+
+func (h *Health) Close() error {
+	return h.s.Close()
+}
+
+// Live checks that a sync has succeeded within HEALTH_MAX_SYNC_AGE, or since the start of the process if there has been none since
+func (h *Health) Live(ctx context.Context) *HealthStatus {
+	status := &HealthStatus{OK: true, Checks: map[string]string{}}
+	var age time.Duration
+	h.check(ctx, status, "firestore", func(ctx context.Context) error {
+		last, err := h.s.database.GetLastSuccess(ctx)
+		if err != nil {
+			return err
+		}
+		since := h.startedAt
+		if !last.EndedAt.IsZero() {
+			status.LastSuccess = &last.EndedAt
+			status.LastSuccessRunID = last.RunID
+			if last.EndedAt.After(since) {
+				since = last.EndedAt
+			}
+		}
+		age = time.Since(since)
+		return nil
+	})
+	if status.Checks["firestore"] != "ok" {
+		return status
+	}
+	h.check(ctx, status, "last_sync", func(ctx context.Context) error {
+		if age > h.s.config.MaxSyncAge {
+			return fmt.Errorf("no successful sync for %s", age.Round(time.Second))
+		}
+		return nil
+	})
+	return status
+}
+
+// Ready also checks that the Notion database and the calendar can be accessed
+func (h *Health) Ready(ctx context.Context) *HealthStatus {
+	status := h.Live(ctx)
+	h.check(ctx, status, "notion", h.s.notion.Ping)
+	h.check(ctx, status, "google_calendar", h.s.google.Ping)
+	return status
+}
+
+// check runs a check with a timeout and records its result
+func (h *Health) check(ctx context.Context, status *HealthStatus, name string, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		status.OK = false
+		status.Checks[name] = err.Error()
+		return
+	}
+	status.Checks[name] = "ok"
+}
@@ -0,0 +1,233 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slog"
+)
+
+// replayJournal finishes the creations interrupted in earlier runs, or rolls them back when their source event
+// was deleted. It returns the IDs of the source events in the journal, which must not be added again.
+func (s *services) replayJournal(
+	ctx context.Context,
+	notionEvents []*db.Event,
+	googleCalendarEvents []*db.Event,
+	skip held,
+) (map[string]bool, error) {
+	entries, err := s.database.ListJournalEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list journal entries: %w", err)
+	}
+
+	listed := map[string]bool{}
+	for _, event := range notionEvents {
+		listed[event.NotionEventID] = true
+	}
+	for _, event := range googleCalendarEvents {
+		listed[event.GoogleCalendarEventID] = true
+	}
+
+	sourceIDs := map[string]bool{}
+	tasks := []task{}
+	for _, entry := range entries {
+		entry := entry
+		sourceIDs[entry.SourceID()] = true
+		if skip[entry.UUID] || skip[entry.SourceID()] { // Dead letter, or source event that cannot be read
+			continue
+		}
+		tasks = append(tasks, task{uuid: entry.UUID, fn: func(ctx context.Context) error {
+			s.failures.attempt(entry.Event)
+			if !listed[entry.SourceID()] {
+				// Only future events are listed, so the source may have started or passed since
+				deleted, err := s.isSourceDeleted(ctx, entry)
+				if err != nil {
+					s.reportResult(entry.Event, OutcomeFailed, err)
+					return err
+				}
+				if deleted {
+					slog.Warn("roll back interrupted creation", "uuid", entry.UUID, "origin", entry.Origin)
+					err := s.rollbackAdd(ctx, entry)
+					s.reportResult(entry.Event, OutcomeDeleted, err)
+					return err
+				}
+			}
+			slog.Warn("replay interrupted creation", "uuid", entry.UUID, "origin", entry.Origin)
+			err := s.completeAdd(ctx, entry, true)
+			s.reportResult(entry.Event, OutcomeCreated, err)
+			return err
+		}})
+	}
+	return sourceIDs, s.exec.run(ctx, tasks)
+}
+
+// isSourceDeleted reports whether the event from which a journaled creation started was deleted
+func (s *services) isSourceDeleted(ctx context.Context, entry *db.JournalEntry) (bool, error) {
+	var deleted bool
+	var err error
+	if entry.Origin == db.OriginNotion {
+		err = s.exec.callNotion(ctx, func() error {
+			deleted, err = s.notion.IsDeleted(ctx, entry.SourceID())
+			return err
+		})
+	} else {
+		err = s.exec.callGoogle(ctx, func() error {
+			deleted, err = s.google.IsDeleted(ctx, entry.SourceID())
+			return err
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("check source event: %w", err)
+	}
+	return deleted, nil
+}
+
+// completeAdd performs the steps of a journaled creation that have not been done yet
+func (s *services) completeAdd(
+	ctx context.Context,
+	entry *db.JournalEntry,
+	replay bool,
+) error {
+	event := entry.Event
+	switch entry.Origin {
+	case db.OriginGoogleCalendar:
+		if event.NotionEventID == "" && replay {
+			// The page may have been created just before the run was interrupted
+			err := s.exec.callNotion(ctx, func() error {
+				notionEventID, err := s.notion.FindEventID(ctx, event.UUID)
+				event.NotionEventID = notionEventID
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("find notion event created by interrupted run: %w", err)
+			}
+		}
+		if event.NotionEventID == "" { // Not yet added to Notion
+			err := s.exec.callNotion(ctx, func() error {
+				notionEventID, err := s.notion.CreateEvent(ctx, event)
+				event.NotionEventID = notionEventID
+				return err
+			})
+			s.record(ctx, db.OriginNotion, db.ActionCreate, nil, event, err)
+			if err != nil {
+				return fmt.Errorf("create notion event for newly added google calendar event: %w", err)
+			}
+			err = s.database.SetJournalEntry(ctx, entry)
+			if err != nil {
+				return fmt.Errorf("record created notion event in journal: %w", err)
+			}
+		}
+		err := s.exec.callGoogle(ctx, func() error {
+			return s.google.UpdateEvent(ctx, event)
+		})
+		s.record(ctx, db.OriginGoogleCalendar, db.ActionUpdate, unlinked(event), event, err)
+		if err != nil {
+			return fmt.Errorf("update uuid for newly added google calendar event: %w", err)
+		}
+	case db.OriginNotion:
+		if event.GoogleCalendarEventID == "" { // Not yet added to Google Calendar
+			// The ID derived from the UUID prevents a duplicate if the event was inserted before the run was interrupted
+			err := s.exec.callGoogle(ctx, func() error {
+				googleCalendarEventID, err := s.google.InsertEvent(ctx, event)
+				event.GoogleCalendarEventID = googleCalendarEventID
+				return err
+			})
+			s.record(ctx, db.OriginGoogleCalendar, db.ActionCreate, nil, event, err)
+			if err != nil {
+				return fmt.Errorf("create google calendar event for newly added notion event: %w", err)
+			}
+			err = s.database.SetJournalEntry(ctx, entry)
+			if err != nil {
+				return fmt.Errorf("record created google calendar event in journal: %w", err)
+			}
+		}
+		err := s.exec.callNotion(ctx, func() error {
+			return s.notion.UpdateEvent(ctx, event)
+		})
+		s.record(ctx, db.OriginNotion, db.ActionUpdate, unlinked(event), event, err)
+		if err != nil {
+			return fmt.Errorf("update uuid for newly added notion event: %w", err)
+		}
+	}
+
+	err := s.database.AddEvent(ctx, event)
+	if replay && errors.Is(err, db.ErrEventExists) { // Added before the run was interrupted
+		err = s.adoptVersion(ctx, event)
+		if err == nil {
+			err = s.database.SetEvent(ctx, event)
+		}
+	}
+	s.record(ctx, db.SideDB, db.ActionCreate, nil, event, err)
+	if err != nil {
+		return fmt.Errorf("add a newly added event to db: %w", err)
+	}
+	err = s.database.DeleteJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("delete completed journal entry: %w", err)
+	}
+	return nil
+}
+
+// rollbackAdd deletes the event created on the other side by a journaled creation
+func (s *services) rollbackAdd(
+	ctx context.Context,
+	entry *db.JournalEntry,
+) error {
+	event := entry.Event
+	switch entry.Origin {
+	case db.OriginGoogleCalendar:
+		if event.NotionEventID == "" {
+			err := s.exec.callNotion(ctx, func() error {
+				notionEventID, err := s.notion.FindEventID(ctx, event.UUID)
+				event.NotionEventID = notionEventID
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("find notion event created by interrupted run: %w", err)
+			}
+		}
+		if event.NotionEventID != "" {
+			err := s.exec.callNotion(ctx, func() error {
+				return s.notion.DeleteEvent(ctx, event)
+			})
+			s.record(ctx, db.OriginNotion, db.ActionDelete, event, nil, err)
+			if err != nil {
+				return fmt.Errorf("delete notion event created by interrupted run: %w", err)
+			}
+		}
+	case db.OriginNotion:
+		if event.GoogleCalendarEventID != "" {
+			err := s.exec.callGoogle(ctx, func() error {
+				return s.google.DeleteEvent(ctx, event)
+			})
+			s.record(ctx, db.OriginGoogleCalendar, db.ActionDelete, event, nil, err)
+			if err != nil {
+				return fmt.Errorf("delete google calendar event created by interrupted run: %w", err)
+			}
+		}
+	}
+
+	// The event may have been added before the run was interrupted
+	err := s.adoptVersion(ctx, event)
+	if err == nil {
+		err = s.database.DeleteEvent(ctx, event)
+	}
+	s.record(ctx, db.SideDB, db.ActionDelete, event, nil, err)
+	if err != nil {
+		return fmt.Errorf("delete db event created by interrupted run: %w", err)
+	}
+	err = s.database.DeleteJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("delete rolled back journal entry: %w", err)
+	}
+	return nil
+}
+
+// unlinked returns the source event of a creation as it was before its UUID was written back
+func unlinked(event *db.Event) *db.Event {
+	source := cloneEvent(event)
+	source.UUID = ""
+	return source
+}
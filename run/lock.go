@@ -0,0 +1,85 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slog"
+)
+
+// runLockName is the name of the lease held by the run in progress
+const runLockName = "run"
+
+// ErrAlreadyRunning is returned when another run is in progress, in this process or in another instance
+var ErrAlreadyRunning = errors.New("another run is in progress")
+
+// runLock is the lease held during a run, renewed in the background
+type runLock struct {
+	holder string
+	cancel context.CancelCauseFunc // Cancels the context of the run
+	stop   context.CancelFunc      // Stops renewing the lease
+	done   chan struct{}
+}
+
+// lock takes the run lock for holder. The returned context is cancelled if the lock is lost.
+func (s *services) lock(ctx context.Context, holder string) (context.Context, error) {
+	ttl := s.config.LockTTL
+	err := s.database.AcquireLease(ctx, runLockName, holder, ttl)
+	if errors.Is(err, db.ErrLeaseHeld) {
+		return nil, fmt.Errorf("%w: %v", ErrAlreadyRunning, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	renewCtx, stop := context.WithCancel(ctx)
+	l := &runLock{holder: holder, cancel: cancel, stop: stop, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := s.database.RenewLease(renewCtx, runLockName, holder, ttl)
+			switch {
+			case err == nil:
+				renewed = time.Now()
+			case renewCtx.Err() != nil:
+				return
+			case errors.Is(err, db.ErrLeaseLost) || time.Since(renewed) >= ttl:
+				// Another run may have started, so this one stops
+				cancel(fmt.Errorf("run lock lost: %w", err))
+				return
+			default: // Retried at the next tick, before the lease expires
+				slog.Warn("renew run lock", "holder", holder, "error", err)
+			}
+		}
+	}()
+	s.runLock = l
+	return runCtx, nil
+}
+
+// unlock stops renewing the run lock and releases it
+func (s *services) unlock() {
+	l := s.runLock
+	if l == nil {
+		return
+	}
+	l.stop()
+	<-l.done
+	l.cancel(nil)
+	// The context of the run may be done
+	if err := s.database.ReleaseLease(context.Background(), runLockName, l.holder); err != nil {
+		slog.Error("release run lock", "holder", l.holder, "error", err)
+	}
+	s.runLock = nil
+}
@@ -0,0 +1,222 @@
+package run
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// field is a part of an event that is merged as a unit
+type field struct {
+	name   string
+	equal  func(a, b *db.Event) bool
+	copy   func(dst, src *db.Event)
+	format func(e *db.Event) string // Used to record the values of a conflict
+}
+
+var fields = []field{
+	{
+		name:   "title",
+		equal:  func(a, b *db.Event) bool { return a.Title == b.Title },
+		copy:   func(dst, src *db.Event) { dst.Title = src.Title },
+		format: func(e *db.Event) string { return e.Title },
+	},
+	{
+		// The start, end and time zone of an event are moved together
+		name: "time",
+		equal: func(a, b *db.Event) bool {
+			return a.StartTime.Equal(b.StartTime) && a.EndTime.Equal(b.EndTime) &&
+				a.IsAllday == b.IsAllday && a.TimeZone == b.TimeZone
+		},
+		copy: func(dst, src *db.Event) {
+			dst.StartTime = src.StartTime
+			dst.EndTime = src.EndTime
+			dst.IsAllday = src.IsAllday
+			dst.TimeZone = src.TimeZone
+		},
+		format: func(e *db.Event) string {
+			if e.IsAllday {
+				return e.StartTime.Format(time.DateOnly) + " - " + e.EndTime.Format(time.DateOnly)
+			}
+			return e.StartTime.Format(time.RFC3339) + " - " + e.EndTime.Format(time.RFC3339) + " " + e.TimeZone
+		},
+	},
+	{
+		// The color is derived from the tags on Notion
+		name: "color",
+		equal: func(a, b *db.Event) bool {
+			return a.Color == b.Color && slices.Equal(a.Tags, b.Tags)
+		},
+		copy: func(dst, src *db.Event) {
+			dst.Color = src.Color
+			dst.Tags = slices.Clone(src.Tags)
+		},
+		format: func(e *db.Event) string {
+			return "color " + e.Color + ", tags " + strings.Join(e.Tags, ", ")
+		},
+	},
+	{
+		name:   "description",
+		equal:  func(a, b *db.Event) bool { return a.Description == b.Description },
+		copy:   func(dst, src *db.Event) { dst.Description = src.Description },
+		format: func(e *db.Event) string { return e.Description },
+	},
+}
+
+// propertyFieldPrefix prefixes the name of a property when it is merged as a field
+const propertyFieldPrefix = "properties."
+
+func isField(name string) bool {
+	return slices.IndexFunc(fields, func(f field) bool { return f.name == name }) >= 0
+}
+
+// propertyField merges a select or status property
+func propertyField(name string) field {
+	return field{
+		name:  propertyFieldPrefix + name,
+		equal: func(a, b *db.Event) bool { return a.Properties[name] == b.Properties[name] },
+		copy: func(dst, src *db.Event) {
+			value := src.Properties[name]
+			if value == "" {
+				delete(dst.Properties, name)
+				return
+			}
+			if dst.Properties == nil {
+				dst.Properties = map[string]string{}
+			}
+			dst.Properties[name] = value
+		},
+		format: func(e *db.Event) string { return e.Properties[name] },
+	}
+}
+
+// eventFields returns the fields of the given events, including every property set on one of them
+func eventFields(events ...*db.Event) []field {
+	names := []string{}
+	for _, event := range events {
+		names = append(names, maps.Keys(event.Properties)...)
+	}
+	slices.Sort(names)
+
+	eventFields := slices.Clone(fields)
+	for _, name := range slices.Compact(names) {
+		eventFields = append(eventFields, propertyField(name))
+	}
+	return eventFields
+}
+
+func cloneEvent(event *db.Event) *db.Event {
+	clone := *event
+	clone.Tags = slices.Clone(event.Tags)
+	clone.Properties = maps.Clone(event.Properties)
+	return &clone
+}
+
+// merge is the result of merging the changes made on both sides into an event
+type merge struct {
+	event  *db.Event // Recorded in the database
+	notion *db.Event // Written to Notion
+	google *db.Event // Written to Google Calendar
+
+	// The events read on each side, completed with the fields they lack from the database
+	notionRead *db.Event
+	googleRead *db.Event
+
+	isNotionUpdated         bool
+	isGoogleCalendarUpdated bool
+	conflicts               []*db.Conflict
+}
+
+// isPending reports whether a field is left as it is on both sides until its conflict is resolved
+func (m *merge) isPending(name string) bool {
+	return slices.IndexFunc(m.conflicts, func(c *db.Conflict) bool { return c.Field == name && c.Winner == "" }) >= 0
+}
+
+// mergeEvent merges the changes made on Notion and Google Calendar since the database version field by field.
+// A field changed differently on both sides is a conflict, resolved by the policy returned by policyOf.
+func mergeEvent(
+	dbEvent *db.Event,
+	notionEvent *db.Event,
+	googleCalendarEvent *db.Event,
+	policyOf func(field string) string,
+) *merge {
+	// The events of the caller are kept as they were read
+	notionEvent = cloneEvent(notionEvent)
+	googleCalendarEvent = cloneEvent(googleCalendarEvent)
+
+	// A side without a time zone keeps the one in the database
+	if notionEvent.TimeZone == "" {
+		notionEvent.TimeZone = dbEvent.TimeZone
+	}
+	if googleCalendarEvent.TimeZone == "" {
+		googleCalendarEvent.TimeZone = dbEvent.TimeZone
+	}
+	if googleCalendarEvent.Tags == nil { // Created before tags were stored on Google Calendar
+		googleCalendarEvent.Tags = dbEvent.Tags
+	}
+	if googleCalendarEvent.Properties == nil { // Created before properties were stored on Google Calendar
+		googleCalendarEvent.Properties = dbEvent.Properties
+	}
+
+	m := &merge{event: cloneEvent(dbEvent), notionRead: notionEvent, googleRead: googleCalendarEvent}
+	pending := []field{}
+	eventFields := eventFields(dbEvent, notionEvent, googleCalendarEvent)
+	for _, f := range eventFields {
+		isNotionChanged := !f.equal(dbEvent, notionEvent)
+		isGoogleCalendarChanged := !f.equal(dbEvent, googleCalendarEvent)
+		switch {
+		case isNotionChanged && !isGoogleCalendarChanged:
+			f.copy(m.event, notionEvent)
+		case !isNotionChanged && isGoogleCalendarChanged:
+			f.copy(m.event, googleCalendarEvent)
+		case isNotionChanged && isGoogleCalendarChanged:
+			if f.equal(notionEvent, googleCalendarEvent) { // Same change on both sides
+				f.copy(m.event, notionEvent)
+				continue
+			}
+			conflict := &db.Conflict{
+				UUID:                dbEvent.UUID,
+				Field:               f.name,
+				Policy:              policyOf(f.name),
+				NotionValue:         f.format(notionEvent),
+				GoogleCalendarValue: f.format(googleCalendarEvent),
+				DetectedAt:          time.Now(),
+			}
+			conflict.Winner = resolve(conflict.Policy, notionEvent, googleCalendarEvent)
+			switch conflict.Winner {
+			case db.OriginNotion:
+				f.copy(m.event, notionEvent)
+			case db.OriginGoogleCalendar:
+				f.copy(m.event, googleCalendarEvent)
+			default: // The database keeps the base value so that the conflict is detected again
+				pending = append(pending, f)
+			}
+			m.conflicts = append(m.conflicts, conflict)
+			slog.Warn("field changed on both sides", "uuid", dbEvent.UUID, "field", f.name, "policy", conflict.Policy, "winner", conflict.Winner)
+		}
+	}
+
+	m.notion = cloneEvent(m.event)
+	m.google = cloneEvent(m.event)
+	for _, f := range pending {
+		f.copy(m.notion, notionEvent)
+		f.copy(m.google, googleCalendarEvent)
+	}
+	m.isNotionUpdated = !equalEvents(m.notion, notionEvent)
+	m.isGoogleCalendarUpdated = !equalEvents(m.google, googleCalendarEvent)
+	return m
+}
+
+// equalEvents reports whether the synchronized fields of a and b are the same
+func equalEvents(a, b *db.Event) bool {
+	for _, f := range eventFields(a, b) {
+		if !f.equal(a, b) {
+			return false
+		}
+	}
+	return true
+}
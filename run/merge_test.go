@@ -0,0 +1,290 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slices"
+)
+
+var mergeStart = time.Date(2023, 10, 1, 10, 0, 0, 0, time.UTC)
+
+// baseEvent returns the event as recorded in the database by the last run
+func baseEvent() *db.Event {
+	return &db.Event{
+		UUID:        "uuid",
+		Title:       "title",
+		StartTime:   mergeStart,
+		EndTime:     mergeStart.Add(time.Hour),
+		TimeZone:    "Asia/Tokyo",
+		Color:       "9",
+		Tags:        []string{"Work"},
+		Description: "description",
+		Properties:  map[string]string{"Status": "Todo"},
+	}
+}
+
+func TestMergeEvent(t *testing.T) {
+	notionNewer := func(e *db.Event) { e.UpdatedTime = mergeStart.Add(time.Minute) }
+	setTitle := func(title string) func(e *db.Event) { return func(e *db.Event) { e.Title = title } }
+	both := func(fns ...func(e *db.Event)) func(e *db.Event) {
+		return func(e *db.Event) {
+			for _, fn := range fns {
+				fn(e)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		notion func(e *db.Event) // Changes made on Notion
+		google func(e *db.Event) // Changes made on Google Calendar
+		policy string
+		want   func(e *db.Event) // Changes recorded in the database, and written to both sides but the conflicting titles
+
+		wantNotionUpdated bool
+		wantGoogleUpdated bool
+		wantConflicts     map[string]string // Winner by field
+	}{
+		{
+			name: "unchanged",
+		},
+		{
+			name:              "title changed on notion",
+			notion:            setTitle("notion"),
+			want:              setTitle("notion"),
+			wantGoogleUpdated: true,
+		},
+		{
+			name:              "description changed on google calendar",
+			google:            func(e *db.Event) { e.Description = "google" },
+			want:              func(e *db.Event) { e.Description = "google" },
+			wantNotionUpdated: true,
+		},
+		{
+			name:              "time changed on google calendar",
+			google:            func(e *db.Event) { e.StartTime, e.EndTime = mergeStart.Add(time.Hour), mergeStart.Add(2*time.Hour) },
+			want:              func(e *db.Event) { e.StartTime, e.EndTime = mergeStart.Add(time.Hour), mergeStart.Add(2*time.Hour) },
+			wantNotionUpdated: true,
+		},
+		{
+			name:              "different fields changed on each side",
+			notion:            setTitle("notion"),
+			google:            func(e *db.Event) { e.Description = "google" },
+			want:              both(setTitle("notion"), func(e *db.Event) { e.Description = "google" }),
+			wantNotionUpdated: true,
+			wantGoogleUpdated: true,
+		},
+		{
+			name:   "same change on both sides",
+			notion: setTitle("both"),
+			google: setTitle("both"),
+			want:   setTitle("both"),
+		},
+		{
+			name:              "conflict won by notion",
+			notion:            setTitle("notion"),
+			google:            setTitle("google"),
+			policy:            PolicyNotionWins,
+			want:              setTitle("notion"),
+			wantGoogleUpdated: true,
+			wantConflicts:     map[string]string{"title": db.OriginNotion},
+		},
+		{
+			name:              "conflict won by google calendar",
+			notion:            setTitle("notion"),
+			google:            setTitle("google"),
+			policy:            PolicyGoogleWins,
+			want:              setTitle("google"),
+			wantNotionUpdated: true,
+			wantConflicts:     map[string]string{"title": db.OriginGoogleCalendar},
+		},
+		{
+			name:              "conflict won by the newest notion",
+			notion:            both(setTitle("notion"), notionNewer),
+			google:            setTitle("google"),
+			policy:            PolicyNewestWins,
+			want:              setTitle("notion"),
+			wantGoogleUpdated: true,
+			wantConflicts:     map[string]string{"title": db.OriginNotion},
+		},
+		{
+			name:              "conflict won by the newest google calendar",
+			notion:            setTitle("notion"),
+			google:            both(setTitle("google"), notionNewer),
+			policy:            PolicyNewestWins,
+			want:              setTitle("google"),
+			wantNotionUpdated: true,
+			wantConflicts:     map[string]string{"title": db.OriginGoogleCalendar},
+		},
+		{
+			name:          "conflict left to the user",
+			notion:        setTitle("notion"),
+			google:        setTitle("google"),
+			policy:        PolicyManual,
+			wantConflicts: map[string]string{"title": ""},
+		},
+		{
+			name:              "conflict left to the user beside a change on one side",
+			notion:            both(setTitle("notion"), func(e *db.Event) { e.Description = "notion" }),
+			google:            setTitle("google"),
+			policy:            PolicyManual,
+			want:              func(e *db.Event) { e.Description = "notion" },
+			wantGoogleUpdated: true,
+			wantConflicts:     map[string]string{"title": ""},
+		},
+		{
+			// Notion pages do not keep the time zone
+			name:   "time zone missing on notion",
+			notion: func(e *db.Event) { e.TimeZone = "" },
+		},
+		{
+			name:              "time zone changed on google calendar",
+			notion:            func(e *db.Event) { e.TimeZone = "" },
+			google:            func(e *db.Event) { e.TimeZone = "Europe/Paris" },
+			want:              func(e *db.Event) { e.TimeZone = "Europe/Paris" },
+			wantNotionUpdated: true,
+		},
+		{
+			// Google Calendar events created by older versions do not store the tags and properties
+			name:   "tags and properties missing on google calendar",
+			google: func(e *db.Event) { e.Tags, e.Properties = nil, nil },
+		},
+		{
+			name:              "tags removed on google calendar",
+			google:            func(e *db.Event) { e.Tags = []string{} },
+			want:              func(e *db.Event) { e.Tags = []string{} },
+			wantNotionUpdated: true,
+		},
+		{
+			name:              "property cleared on google calendar",
+			google:            func(e *db.Event) { e.Properties = map[string]string{} },
+			want:              func(e *db.Event) { delete(e.Properties, "Status") },
+			wantNotionUpdated: true,
+		},
+		{
+			name:              "property set on notion",
+			notion:            func(e *db.Event) { e.Properties["Stage"] = "Draft" },
+			want:              func(e *db.Event) { e.Properties["Stage"] = "Draft" },
+			wantGoogleUpdated: true,
+		},
+		{
+			name:              "property conflict won by notion",
+			notion:            func(e *db.Event) { e.Properties["Status"] = "Doing" },
+			google:            func(e *db.Event) { e.Properties["Status"] = "Done" },
+			policy:            PolicyNotionWins,
+			want:              func(e *db.Event) { e.Properties["Status"] = "Doing" },
+			wantGoogleUpdated: true,
+			wantConflicts:     map[string]string{"properties.Status": db.OriginNotion},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apply := func(fn func(e *db.Event), e *db.Event) *db.Event {
+				if fn != nil {
+					fn(e)
+				}
+				return e
+			}
+			notionEvent := apply(tt.notion, baseEvent())
+			googleCalendarEvent := apply(tt.google, baseEvent())
+			want := apply(tt.want, baseEvent())
+			wantNotion, wantGoogle := cloneEvent(want), cloneEvent(want)
+			if tt.policy == PolicyManual { // The conflicting titles are kept on each side
+				wantNotion.Title, wantGoogle.Title = notionEvent.Title, googleCalendarEvent.Title
+			}
+
+			m := mergeEvent(baseEvent(), notionEvent, googleCalendarEvent, func(string) string { return tt.policy })
+
+			if !equalEvents(m.event, want) {
+				t.Errorf("event = %+v, want %+v", m.event, want)
+			}
+			if !equalEvents(m.notion, wantNotion) {
+				t.Errorf("notion event = %+v, want %+v", m.notion, wantNotion)
+			}
+			if !equalEvents(m.google, wantGoogle) {
+				t.Errorf("google calendar event = %+v, want %+v", m.google, wantGoogle)
+			}
+			if m.isNotionUpdated != tt.wantNotionUpdated || m.isGoogleCalendarUpdated != tt.wantGoogleUpdated {
+				t.Errorf("updated = notion %v, google calendar %v, want %v, %v",
+					m.isNotionUpdated, m.isGoogleCalendarUpdated, tt.wantNotionUpdated, tt.wantGoogleUpdated)
+			}
+			conflicts := map[string]string{}
+			for _, c := range m.conflicts {
+				conflicts[c.Field] = c.Winner
+				if c.Policy != tt.policy {
+					t.Errorf("conflict on %s has policy %q, want %q", c.Field, c.Policy, tt.policy)
+				}
+			}
+			if len(conflicts) != len(tt.wantConflicts) {
+				t.Fatalf("conflicts = %v, want %v", conflicts, tt.wantConflicts)
+			}
+			for field, winner := range tt.wantConflicts {
+				if got, ok := conflicts[field]; !ok || got != winner {
+					t.Errorf("conflict on %s won by %q, want %q", field, got, winner)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeEventPolicyPerField(t *testing.T) {
+	notionEvent, googleCalendarEvent := baseEvent(), baseEvent()
+	notionEvent.Title, googleCalendarEvent.Title = "notion", "google"
+	notionEvent.Description, googleCalendarEvent.Description = "notion", "google"
+	policies := map[string]string{"title": PolicyNotionWins, "description": PolicyGoogleWins}
+
+	m := mergeEvent(baseEvent(), notionEvent, googleCalendarEvent, func(field string) string { return policies[field] })
+
+	if m.event.Title != "notion" || m.event.Description != "google" {
+		t.Errorf("event title %q, description %q, want %q, %q", m.event.Title, m.event.Description, "notion", "google")
+	}
+	if !m.isNotionUpdated || !m.isGoogleCalendarUpdated {
+		t.Errorf("updated = notion %v, google calendar %v, want both", m.isNotionUpdated, m.isGoogleCalendarUpdated)
+	}
+}
+
+func TestMergeEventKeepsReadEvents(t *testing.T) {
+	notionEvent, googleCalendarEvent := baseEvent(), baseEvent()
+	notionEvent.TimeZone = ""
+	googleCalendarEvent.Tags, googleCalendarEvent.Properties = nil, nil
+
+	m := mergeEvent(baseEvent(), notionEvent, googleCalendarEvent, func(string) string { return PolicyManual })
+
+	if notionEvent.TimeZone != "" || googleCalendarEvent.Tags != nil || googleCalendarEvent.Properties != nil {
+		t.Errorf("read events changed to notion %+v, google calendar %+v", notionEvent, googleCalendarEvent)
+	}
+	if !equalEvents(m.googleRead, baseEvent()) || m.googleRead.Tags == nil {
+		t.Errorf("google calendar event read = %+v, want the tags and properties of the database", m.googleRead)
+	}
+	if m.isNotionUpdated || m.isGoogleCalendarUpdated {
+		t.Errorf("updated = notion %v, google calendar %v, want neither", m.isNotionUpdated, m.isGoogleCalendarUpdated)
+	}
+}
+
+func TestEventFields(t *testing.T) {
+	a := &db.Event{Properties: map[string]string{"Status": "Todo", "Stage": "Draft"}}
+	b := &db.Event{Properties: map[string]string{"Status": "Done", "Priority": "High"}}
+	var names []string
+	for _, f := range eventFields(a, b, &db.Event{}) {
+		names = append(names, f.name)
+	}
+	want := []string{"title", "time", "color", "description", "properties.Priority", "properties.Stage", "properties.Status"}
+	if !slices.Equal(names, want) {
+		t.Errorf("eventFields() = %v, want %v", names, want)
+	}
+}
+
+func TestPropertyFieldCopy(t *testing.T) {
+	f := propertyField("Status")
+	dst := &db.Event{}
+	f.copy(dst, &db.Event{Properties: map[string]string{"Status": "Done"}})
+	if dst.Properties["Status"] != "Done" {
+		t.Errorf("copied property = %q, want %q", dst.Properties["Status"], "Done")
+	}
+	f.copy(dst, &db.Event{})
+	if _, ok := dst.Properties["Status"]; ok {
+		t.Errorf("cleared property = %q, want none", dst.Properties["Status"])
+	}
+}
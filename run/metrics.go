@@ -0,0 +1,100 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// metrics records the outcome of runs, shared by the runs of a process
+type metrics struct {
+	operations  metric.Int64Counter
+	conflicts   metric.Int64Counter
+	runDuration metric.Float64Histogram
+	rateWait    metric.Float64Counter
+	lastSuccess atomic.Int64 // Unix time of the end of the last successful sync
+}
+
+var (
+	sharedMetrics    *metrics
+	sharedMetricsErr error
+	metricsOnce      sync.Once
+)
+
+func newMetrics() (*metrics, error) {
+	metricsOnce.Do(func() {
+		sharedMetrics, sharedMetricsErr = createMetrics()
+	})
+	return sharedMetrics, sharedMetricsErr
+}
+
+func createMetrics() (*metrics, error) {
+	meter := telemetry.Meter()
+	m := &metrics{}
+	var err error
+	m.operations, err = meter.Int64Counter("operations",
+		metric.WithDescription("Number of creations, updates and deletions by side written to and result"))
+	if err != nil {
+		return nil, fmt.Errorf("create operation counter: %w", err)
+	}
+	m.conflicts, err = meter.Int64Counter("conflicts",
+		metric.WithDescription("Number of fields changed differently on both sides by field, policy and winner"))
+	if err != nil {
+		return nil, fmt.Errorf("create conflict counter: %w", err)
+	}
+	m.runDuration, err = meter.Float64Histogram("run.duration",
+		metric.WithDescription("Duration of the runs by command and result"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("create run duration histogram: %w", err)
+	}
+	m.rateWait, err = meter.Float64Counter("notion.rate_limit.wait",
+		metric.WithDescription("Time spent waiting for the Notion rate limiter by command"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("create rate limit wait counter: %w", err)
+	}
+	_, err = meter.Int64ObservableGauge("run.last_success",
+		metric.WithDescription("Unix time of the end of the last successful sync, zero if none"),
+		metric.WithUnit("s"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.lastSuccess.Load())
+			return nil
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("create last success gauge: %w", err)
+	}
+	return m, nil
+}
+
+func result(err error) attribute.KeyValue {
+	if err != nil {
+		return attribute.String("result", "error")
+	}
+	return attribute.String("result", "success")
+}
+
+func (m *metrics) operation(ctx context.Context, side string, action string, err error) {
+	m.operations.Add(ctx, 1, metric.WithAttributes(attribute.String("side", side), attribute.String("action", action), result(err)))
+}
+
+func (m *metrics) conflict(ctx context.Context, field string, policy string, winner string) {
+	m.conflicts.Add(ctx, 1, metric.WithAttributes(attribute.String("field", field), attribute.String("policy", policy), attribute.String("winner", winner)))
+}
+
+func (m *metrics) rateLimitWait(ctx context.Context, command string, wait time.Duration) {
+	m.rateWait.Add(ctx, wait.Seconds(), metric.WithAttributes(attribute.String("command", command)))
+}
+
+func (m *metrics) run(ctx context.Context, command string, start time.Time, end time.Time, err error) {
+	m.runDuration.Record(ctx, end.Sub(start).Seconds(), metric.WithAttributes(attribute.String("command", command), result(err)))
+	if command == "sync" && err == nil {
+		m.lastSuccess.Store(end.Unix())
+	}
+}
@@ -0,0 +1,88 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/notify"
+	"golang.org/x/exp/slog"
+)
+
+// notifyTimeout bounds the time spent sending the notifications of a run
+const notifyTimeout = 10 * time.Second
+
+// withoutCancel keeps the values of a context, such as the span, but not its cancellation or deadline,
+// like context.WithoutCancel of Go 1.21
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
+
+// notify tells about a run that failed or was stopped by a guard, and about the conflicts left to the user
+// and the events moved to the dead letters by the run. Notifications that cannot be sent are only logged.
+func (s *services) notify(ctx context.Context, err error) {
+	now := time.Now()
+	runID := s.audit.record.ID
+	notifications := []*notify.Notification{}
+	switch {
+	case errors.Is(err, ErrMassDeletion):
+		notifications = append(notifications, &notify.Notification{
+			Kind:  notify.KindGuard,
+			Title: "Sync stopped by the mass deletion guard",
+			Text:  err.Error() + "\nCheck the listed events, then run sync with -allow-mass-deletion if the deletions are intended.",
+		})
+	case err != nil:
+		notifications = append(notifications, &notify.Notification{
+			Kind:  notify.KindRunFailed,
+			Title: "Sync failed",
+			Text:  err.Error(),
+		})
+	}
+
+	lines := []string{}
+	for _, conflict := range s.report.Conflicts {
+		if conflict.Winner == "" {
+			lines = append(lines, fmt.Sprintf("%s %s: %q on Notion, %q on Google Calendar",
+				conflict.UUID, conflict.Field, conflict.NotionValue, conflict.GoogleCalendarValue))
+		}
+	}
+	if len(lines) > 0 {
+		notifications = append(notifications, &notify.Notification{
+			Kind:  notify.KindConflicts,
+			Title: fmt.Sprintf("%d conflicts left to pick a side for", len(lines)),
+			Text:  strings.Join(lines, "\n") + "\nResolve them with the conflicts command or the conflict flag on Notion.",
+		})
+	}
+
+	lines = []string{}
+	for _, failed := range s.report.DeadLetters {
+		lines = append(lines, fmt.Sprintf("%s %q: %s", failed.Key, failed.Title, failed.Error))
+	}
+	if len(lines) > 0 {
+		notifications = append(notifications, &notify.Notification{
+			Kind:  notify.KindDeadLetters,
+			Title: fmt.Sprintf("%d events moved to the dead letters", len(lines)),
+			Text:  strings.Join(lines, "\n") + "\nRetry or discard them with the dead-letters command.",
+		})
+	}
+
+	if len(notifications) == 0 {
+		return
+	}
+	// The run context is cancelled when the run lock is lost, which fails the run to notify about
+	ctx, cancel := context.WithTimeout(withoutCancel{ctx}, notifyTimeout)
+	defer cancel()
+	for _, n := range notifications {
+		n.RunID = runID
+		n.At = now
+		if err := s.notifier.Notify(ctx, n); err != nil {
+			slog.Error("notify", "kind", n.Kind, "error", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+)
+
+// Policies to resolve a field changed differently on Notion and Google Calendar
+const (
+	PolicyNotionWins = "notion-wins"
+	PolicyGoogleWins = "google-wins"
+	PolicyNewestWins = "newest-wins" // The side whose event was updated last wins
+	PolicyManual     = "manual"      // The field is not synchronized until the conflict is resolved
+)
+
+func validatePolicies(cfg Config) error {
+	policies := map[string]string{"": cfg.ConflictPolicy}
+	for field, policy := range cfg.ConflictFieldPolicies {
+		policies[field] = policy
+	}
+	for field, policy := range policies {
+		switch policy {
+		case PolicyNotionWins, PolicyGoogleWins, PolicyNewestWins, PolicyManual:
+		default:
+			return fmt.Errorf("unknown conflict policy %q for field %q", policy, field)
+		}
+		if field != "" && !isField(field) && field != "properties" && !strings.HasPrefix(field, propertyFieldPrefix) {
+			return fmt.Errorf("unknown field %q in conflict policies", field)
+		}
+	}
+	return nil
+}
+
+// conflictPolicy returns the policy for a field, falling back to the policy for all properties and then to the default
+func (c Config) conflictPolicy(field string) string {
+	if policy, ok := c.ConflictFieldPolicies[field]; ok {
+		return policy
+	}
+	if strings.HasPrefix(field, propertyFieldPrefix) {
+		if policy, ok := c.ConflictFieldPolicies["properties"]; ok {
+			return policy
+		}
+	}
+	return c.ConflictPolicy
+}
+
+// resolve returns the side whose value wins a conflict, or an empty string if the conflict is left to the user
+func resolve(policy string, notionEvent *db.Event, googleCalendarEvent *db.Event) string {
+	switch policy {
+	case PolicyNotionWins:
+		return db.OriginNotion
+	case PolicyGoogleWins:
+		return db.OriginGoogleCalendar
+	case PolicyNewestWins:
+		if notionEvent.UpdatedTime.After(googleCalendarEvent.UpdatedTime) {
+			return db.OriginNotion
+		}
+		return db.OriginGoogleCalendar
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// task is a unit of work on a single event
+type task struct {
+	uuid string // Empty if the event has no UUID yet
+	id   string // ID of the event on its side, which names a task without a UUID
+	fn   func(ctx context.Context) error
+}
+
+// name names the event of the task in errors
+func (t task) name() string {
+	if t.uuid == "" {
+		return fmt.Sprintf("new event %q", t.id)
+	}
+	return fmt.Sprintf("event %q", t.uuid)
+}
+
+// executor runs tasks on a bounded number of workers and limits the concurrent calls to each provider.
+// Tasks with the same UUID run one after another in the order given.
+type executor struct {
+	workers int
+	notion  chan struct{}
+	google  chan struct{}
+}
+
+func newExecutor(cfg Config) *executor {
+	return &executor{
+		workers: cfg.Workers,
+		notion:  make(chan struct{}, cfg.NotionConcurrency),
+		google:  make(chan struct{}, cfg.GoogleConcurrency),
+	}
+}
+
+// run executes tasks and returns their errors joined in the order of tasks.
+// Once ctx is done, the tasks not started yet are dropped and the cause is returned along with the errors.
+func (e *executor) run(ctx context.Context, tasks []task) error {
+	// Group tasks by UUID to keep operations on the same event ordered
+	groups := [][]int{}
+	groupIndex := map[string]int{}
+	for i, t := range tasks {
+		if t.uuid == "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+		g, ok := groupIndex[t.uuid]
+		if !ok {
+			g = len(groups)
+			groupIndex[t.uuid] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	errs := make([]error, len(tasks))
+	queue := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < e.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, i := range group {
+					if err := tasks[i].fn(ctx); err != nil {
+						errs[i] = fmt.Errorf("%s: %w", tasks[i].name(), err)
+						break // Later operations on the same event depend on this one
+					}
+				}
+			}
+		}()
+	}
+dispatch:
+	for _, group := range groups {
+		select {
+		case queue <- group:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		errs = append(errs, context.Cause(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// callNotion calls fn while holding one of the Notion slots, unless ctx is done while waiting for one
+func (e *executor) callNotion(ctx context.Context, fn func() error) error {
+	select {
+	case e.notion <- struct{}{}:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	defer func() { <-e.notion }()
+	return fn()
+}
+
+// callGoogle calls fn while holding one of the Google Calendar slots, unless ctx is done while waiting for one
+func (e *executor) callGoogle(ctx context.Context, fn func() error) error {
+	select {
+	case e.google <- struct{}{}:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	defer func() { <-e.google }()
+	return fn()
+}
@@ -0,0 +1,147 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestExecutorOrdersTasksPerUUID(t *testing.T) {
+	e := newExecutor(Config{Workers: 8, NotionConcurrency: 8, GoogleConcurrency: 8})
+	var mu sync.Mutex
+	order := map[string][]int{}
+	tasks := []task{}
+	for i := 0; i < 30; i++ {
+		i := i
+		uuid := fmt.Sprintf("uuid-%d", i%3)
+		tasks = append(tasks, task{uuid: uuid, fn: func(ctx context.Context) error {
+			time.Sleep(time.Millisecond) // Lets the other workers interleave
+			mu.Lock()
+			defer mu.Unlock()
+			order[uuid] = append(order[uuid], i)
+			return nil
+		}})
+	}
+	if err := e.run(context.Background(), tasks); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for uuid, indexes := range order {
+		if len(indexes) != 10 || !slices.IsSorted(indexes) {
+			t.Errorf("tasks of %s ran in order %v, want 10 tasks in the given order", uuid, indexes)
+		}
+	}
+}
+
+func TestExecutorStopsEventAfterFailure(t *testing.T) {
+	e := newExecutor(Config{Workers: 2, NotionConcurrency: 1, GoogleConcurrency: 1})
+	var ran []string
+	var mu sync.Mutex
+	record := func(name string, err error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return err
+		}
+	}
+	tasks := []task{
+		{uuid: "a", fn: record("a1", errors.New("failed"))},
+		{uuid: "a", fn: record("a2", nil)}, // Depends on a1
+		{uuid: "b", fn: record("b1", nil)},
+		{id: "page-id", fn: record("new", errors.New("rejected"))},
+	}
+	err := e.run(context.Background(), tasks)
+	if err == nil {
+		t.Fatal("run() error = nil, want the errors of a1 and new")
+	}
+	for _, want := range []string{`event "a": failed`, `new event "page-id": rejected`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("run() error = %v, want %q", err, want)
+		}
+	}
+	slices.Sort(ran)
+	if want := []string{"a1", "b1", "new"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
+
+func TestExecutorStopsWhenCancelled(t *testing.T) {
+	e := newExecutor(Config{Workers: 1, NotionConcurrency: 1, GoogleConcurrency: 1})
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	cause := errors.New("run lock lost")
+	var ran atomic.Int32
+	tasks := []task{}
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, task{uuid: fmt.Sprintf("uuid-%d", i), fn: func(ctx context.Context) error {
+			ran.Add(1)
+			cancel(cause)
+			return nil
+		}})
+	}
+	err := e.run(ctx, tasks)
+	if !errors.Is(err, cause) {
+		t.Errorf("run() error = %v, want %v", err, cause)
+	}
+	// The worker may have taken one more task before the cancellation was seen
+	if n := ran.Load(); n > 2 {
+		t.Errorf("%d tasks ran, want at most 2", n)
+	}
+}
+
+func TestExecutorLimitsCalls(t *testing.T) {
+	e := newExecutor(Config{Workers: 8, NotionConcurrency: 2, GoogleConcurrency: 1})
+	var notion, google, peakNotion, peakGoogle atomic.Int32
+	call := func(current *atomic.Int32, peak *atomic.Int32) func() error {
+		return func() error {
+			n := current.Add(1)
+			defer current.Add(-1)
+			for {
+				m := peak.Load()
+				if n <= m || peak.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		}
+	}
+	tasks := []task{}
+	for i := 0; i < 20; i++ {
+		tasks = append(tasks, task{uuid: fmt.Sprintf("uuid-%d", i), fn: func(ctx context.Context) error {
+			if err := e.callNotion(ctx, call(&notion, &peakNotion)); err != nil {
+				return err
+			}
+			return e.callGoogle(ctx, call(&google, &peakGoogle))
+		}})
+	}
+	if err := e.run(context.Background(), tasks); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if peakNotion.Load() > 2 || peakGoogle.Load() > 1 {
+		t.Errorf("concurrent calls = notion %d, google calendar %d, want at most 2, 1", peakNotion.Load(), peakGoogle.Load())
+	}
+}
+
+func TestCallNotionCancelledWhileWaiting(t *testing.T) {
+	e := newExecutor(Config{Workers: 1, NotionConcurrency: 1, GoogleConcurrency: 1})
+	e.notion <- struct{}{} // Every slot is taken
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("interrupted")
+	cancel(cause)
+	called := false
+	err := e.callNotion(ctx, func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, cause) || called {
+		t.Errorf("callNotion() error = %v, called %v, want %v without calling", err, called, cause)
+	}
+}
@@ -0,0 +1,241 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// Kinds of inconsistencies found by Repair
+const (
+	IssueOrphan    = "orphan"    // An event has a UUID unknown to the database
+	IssueDuplicate = "duplicate" // Several events on the same side have the same UUID
+	IssueDangling  = "dangling"  // A database mapping points to events that do not exist
+)
+
+// Fixes proposed by Repair
+const (
+	FixRelink = "relink" // Record the events found on both sides in the database
+	FixMerge  = "merge"  // Keep one of the duplicates and delete the others
+	FixDelete = "delete" // Delete the event or the mapping
+)
+
+// Issue is an inconsistency between Notion, Google Calendar and the database
+type Issue struct {
+	Kind   string
+	Fix    string
+	UUID   string
+	Side   string // db.OriginNotion, db.OriginGoogleCalendar, or "db"
+	ID     string // ID of the event on Side
+	Detail string
+	Err    error // Set if the fix failed to be applied
+
+	mapping *db.Event // Database record written by FixRelink
+	event   *db.Event // Event or database record before the fix, recorded in the audit log
+}
+
+// Repair scans both providers and the database for orphans, duplicates and dangling mappings.
+// The proposed fixes are applied only if apply is true.
+func Repair(apply bool) (issues []*Issue, err error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if apply {
+		// The events are listed under the run lock, so that no sync changes them before the fixes
+		ctx, err = s.beginRun(ctx, "repair", db.TriggerCLI)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { s.endRun(ctx, errors.Join(append(issueErrors(issues), err)...)) }()
+	}
+
+	notionEvents, googleCalendarEvents, invalid, err := s.listEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 { // Events that cannot be read would be taken for missing ones
+		return nil, fmt.Errorf("fix the events that cannot be read first: %w", joinInvalid(invalid))
+	}
+	dbEvents, err := s.database.ListEvents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list db events: %w", err)
+	}
+	entries, err := s.database.ListJournalEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list journal entries: %w", err)
+	}
+
+	issues = findIssues(notionEvents, googleCalendarEvents, dbEvents, entries)
+	if !apply {
+		return issues, nil
+	}
+	for _, issue := range issues {
+		issue.Err = s.applyFix(ctx, issue)
+		if issue.Err != nil {
+			slog.Error("apply fix", "kind", issue.Kind, "fix", issue.Fix, "uuid", issue.UUID, "error", issue.Err)
+		}
+	}
+	return issues, nil
+}
+
+// findIssues classifies the inconsistencies between the listed events and the database
+func findIssues(notionEvents []*db.Event, googleCalendarEvents []*db.Event, dbEvents []*db.Event, entries []*db.JournalEntry) []*Issue {
+	notionByUUID := groupByUUID(notionEvents)
+	googleByUUID := groupByUUID(googleCalendarEvents)
+	dbByUUID := getEventsIDMap(dbEvents)
+	journaled := map[string]bool{}
+	for _, entry := range entries {
+		journaled[entry.UUID] = true
+	}
+
+	uuids := append(maps.Keys(notionByUUID), maps.Keys(googleByUUID)...)
+	uuids = append(uuids, maps.Keys(dbByUUID)...)
+	slices.Sort(uuids)
+	uuids = slices.Compact(uuids)
+
+	issues := []*Issue{}
+	for _, uuid := range uuids {
+		if journaled[uuid] { // Finished by the next run
+			continue
+		}
+		dbEvent := dbByUUID[uuid]
+
+		var notionEvent, googleCalendarEvent *db.Event
+		if events := notionByUUID[uuid]; len(events) > 0 {
+			keepID := ""
+			if dbEvent != nil {
+				keepID = dbEvent.NotionEventID
+			}
+			var duplicates []*db.Event
+			notionEvent, duplicates = pickDuplicate(events, keepID, func(e *db.Event) string { return e.NotionEventID })
+			for _, d := range duplicates {
+				issues = append(issues, &Issue{Kind: IssueDuplicate, Fix: FixMerge, UUID: uuid, Side: db.OriginNotion, ID: d.NotionEventID, event: d,
+					Detail: fmt.Sprintf("keep %s", notionEvent.NotionEventID)})
+			}
+		}
+		if events := googleByUUID[uuid]; len(events) > 0 {
+			keepID := ""
+			if dbEvent != nil {
+				keepID = dbEvent.GoogleCalendarEventID
+			}
+			var duplicates []*db.Event
+			googleCalendarEvent, duplicates = pickDuplicate(events, keepID, func(e *db.Event) string { return e.GoogleCalendarEventID })
+			for _, d := range duplicates {
+				issues = append(issues, &Issue{Kind: IssueDuplicate, Fix: FixMerge, UUID: uuid, Side: db.OriginGoogleCalendar, ID: d.GoogleCalendarEventID, event: d,
+					Detail: fmt.Sprintf("keep %s", googleCalendarEvent.GoogleCalendarEventID)})
+			}
+		}
+
+		switch {
+		case dbEvent == nil && notionEvent != nil && googleCalendarEvent != nil:
+			mapping := *notionEvent
+			mapping.GoogleCalendarEventID = googleCalendarEvent.GoogleCalendarEventID
+			issues = append(issues, &Issue{Kind: IssueOrphan, Fix: FixRelink, UUID: uuid, Side: "db", mapping: &mapping,
+				Detail: fmt.Sprintf("notion %s, google calendar %s", notionEvent.NotionEventID, googleCalendarEvent.GoogleCalendarEventID)})
+		case dbEvent == nil && notionEvent != nil:
+			issues = append(issues, &Issue{Kind: IssueOrphan, Fix: FixDelete, UUID: uuid, Side: db.OriginNotion, ID: notionEvent.NotionEventID, event: notionEvent,
+				Detail: "no counterpart on google calendar"})
+		case dbEvent == nil && googleCalendarEvent != nil:
+			issues = append(issues, &Issue{Kind: IssueOrphan, Fix: FixDelete, UUID: uuid, Side: db.OriginGoogleCalendar, ID: googleCalendarEvent.GoogleCalendarEventID, event: googleCalendarEvent,
+				Detail: "no counterpart on notion"})
+		case dbEvent != nil && notionEvent != nil && googleCalendarEvent != nil:
+			if dbEvent.NotionEventID != notionEvent.NotionEventID || dbEvent.GoogleCalendarEventID != googleCalendarEvent.GoogleCalendarEventID {
+				mapping := *dbEvent
+				mapping.NotionEventID = notionEvent.NotionEventID
+				mapping.GoogleCalendarEventID = googleCalendarEvent.GoogleCalendarEventID
+				issues = append(issues, &Issue{Kind: IssueDangling, Fix: FixRelink, UUID: uuid, Side: "db", mapping: &mapping, event: dbEvent,
+					Detail: fmt.Sprintf("notion %s, google calendar %s", notionEvent.NotionEventID, googleCalendarEvent.GoogleCalendarEventID)})
+			}
+		case dbEvent != nil && notionEvent == nil && googleCalendarEvent == nil:
+			// Past events are not listed, so only future mappings can be told to be dangling
+			if dbEvent.EndTime.After(time.Now()) {
+				issues = append(issues, &Issue{Kind: IssueDangling, Fix: FixDelete, UUID: uuid, Side: "db", event: dbEvent,
+					Detail: "no event on either side"})
+			}
+		}
+	}
+	return issues
+}
+
+func groupByUUID(events []*db.Event) map[string][]*db.Event {
+	m := make(map[string][]*db.Event)
+	for _, event := range events {
+		if event.UUID != "" {
+			m[event.UUID] = append(m[event.UUID], event)
+		}
+	}
+	return m
+}
+
+// pickDuplicate keeps the event with keepID, or the oldest one, and returns the others as duplicates
+func pickDuplicate(events []*db.Event, keepID string, id func(*db.Event) string) (*db.Event, []*db.Event) {
+	keep := events[0]
+	for _, e := range events[1:] {
+		if id(keep) == keepID {
+			break
+		}
+		if id(e) == keepID || e.CreatedTime.Before(keep.CreatedTime) {
+			keep = e
+		}
+	}
+	duplicates := []*db.Event{}
+	for _, e := range events {
+		if e != keep {
+			duplicates = append(duplicates, e)
+		}
+	}
+	return keep, duplicates
+}
+
+// applyFix applies the fix proposed for an issue
+func (s *services) applyFix(ctx context.Context, issue *Issue) error {
+	switch {
+	case issue.Fix == FixMerge || (issue.Fix == FixDelete && issue.Side != "db"):
+		event := &db.Event{UUID: issue.UUID}
+		var err error
+		if issue.Side == db.OriginNotion {
+			event.NotionEventID = issue.ID
+			err = s.notion.DeleteEvent(ctx, event)
+		} else {
+			event.GoogleCalendarEventID = issue.ID
+			err = s.google.DeleteEvent(ctx, event)
+		}
+		s.record(ctx, issue.Side, db.ActionDelete, issue.event, nil, err)
+		return err
+	case issue.Fix == FixDelete:
+		err := s.database.DeleteEvent(ctx, &db.Event{UUID: issue.UUID, Version: issue.event.Version})
+		s.record(ctx, db.SideDB, db.ActionDelete, issue.event, nil, err)
+		return err
+	case issue.Fix == FixRelink:
+		err := s.database.SetEvent(ctx, issue.mapping)
+		action := db.ActionUpdate
+		if issue.event == nil {
+			action = db.ActionCreate
+		}
+		s.record(ctx, db.SideDB, action, issue.event, issue.mapping, err)
+		return err
+	}
+	return fmt.Errorf("unknown fix %q", issue.Fix)
+}
+
+// issueErrors returns the errors of the fixes that failed
+func issueErrors(issues []*Issue) []error {
+	errs := []error{}
+	for _, issue := range issues {
+		if issue.Err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", issue.Fix, issue.UUID, issue.Err))
+		}
+	}
+	return errs
+}
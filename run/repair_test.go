@@ -0,0 +1,160 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+)
+
+func TestPickDuplicate(t *testing.T) {
+	now := time.Now()
+	events := []*db.Event{
+		{NotionEventID: "newest", CreatedTime: now},
+		{NotionEventID: "oldest", CreatedTime: now.Add(-2 * time.Hour)},
+		{NotionEventID: "older", CreatedTime: now.Add(-time.Hour)},
+	}
+	id := func(e *db.Event) string { return e.NotionEventID }
+
+	tests := []struct {
+		name   string
+		keepID string
+		want   string
+	}{
+		{name: "oldest kept", want: "oldest"},
+		{name: "recorded one kept", keepID: "newest", want: "newest"},
+		{name: "recorded one kept over older ones", keepID: "older", want: "older"},
+		{name: "unknown recorded one", keepID: "missing", want: "oldest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, duplicates := pickDuplicate(events, tt.keepID, id)
+			if keep.NotionEventID != tt.want {
+				t.Errorf("kept %s, want %s", keep.NotionEventID, tt.want)
+			}
+			if len(duplicates) != len(events)-1 {
+				t.Fatalf("duplicates = %d, want %d", len(duplicates), len(events)-1)
+			}
+			for _, d := range duplicates {
+				if d == keep {
+					t.Errorf("kept event %s is also a duplicate", keep.NotionEventID)
+				}
+			}
+		})
+	}
+}
+
+func TestFindIssues(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	past := time.Now().Add(-24 * time.Hour)
+	notionEvent := func(uuid string, id string) *db.Event {
+		return &db.Event{UUID: uuid, NotionEventID: id, EndTime: future}
+	}
+	googleEvent := func(uuid string, id string) *db.Event {
+		return &db.Event{UUID: uuid, GoogleCalendarEventID: id, EndTime: future}
+	}
+	mapping := func(uuid string, notionID string, googleID string, end time.Time) *db.Event {
+		return &db.Event{UUID: uuid, NotionEventID: notionID, GoogleCalendarEventID: googleID, EndTime: end}
+	}
+
+	type issue struct {
+		kind string
+		fix  string
+		side string
+		id   string
+	}
+	tests := []struct {
+		name    string
+		notion  []*db.Event
+		google  []*db.Event
+		db      []*db.Event
+		journal []*db.JournalEntry
+		want    []issue
+	}{
+		{
+			name:   "consistent",
+			notion: []*db.Event{notionEvent("u", "n")},
+			google: []*db.Event{googleEvent("u", "g")},
+			db:     []*db.Event{mapping("u", "n", "g", future)},
+		},
+		{
+			name:   "events without a UUID are left to the next sync",
+			notion: []*db.Event{notionEvent("", "n")},
+			google: []*db.Event{googleEvent("", "g")},
+		},
+		{
+			name:   "orphans on both sides relinked",
+			notion: []*db.Event{notionEvent("u", "n")},
+			google: []*db.Event{googleEvent("u", "g")},
+			want:   []issue{{IssueOrphan, FixRelink, "db", ""}},
+		},
+		{
+			name:   "orphan on notion deleted",
+			notion: []*db.Event{notionEvent("u", "n")},
+			want:   []issue{{IssueOrphan, FixDelete, db.OriginNotion, "n"}},
+		},
+		{
+			name:   "orphan on google calendar deleted",
+			google: []*db.Event{googleEvent("u", "g")},
+			want:   []issue{{IssueOrphan, FixDelete, db.OriginGoogleCalendar, "g"}},
+		},
+		{
+			name:   "duplicate merged into the recorded event",
+			notion: []*db.Event{notionEvent("u", "n2"), notionEvent("u", "n")},
+			google: []*db.Event{googleEvent("u", "g")},
+			db:     []*db.Event{mapping("u", "n", "g", future)},
+			want:   []issue{{IssueDuplicate, FixMerge, db.OriginNotion, "n2"}},
+		},
+		{
+			name:   "mapping pointing to other events relinked",
+			notion: []*db.Event{notionEvent("u", "n2")},
+			google: []*db.Event{googleEvent("u", "g")},
+			db:     []*db.Event{mapping("u", "n", "g", future)},
+			want:   []issue{{IssueDangling, FixRelink, "db", ""}},
+		},
+		{
+			name: "future mapping without events deleted",
+			db:   []*db.Event{mapping("u", "n", "g", future)},
+			want: []issue{{IssueDangling, FixDelete, "db", ""}},
+		},
+		{
+			name: "past mapping kept",
+			db:   []*db.Event{mapping("u", "n", "g", past)},
+		},
+		{
+			name:    "journaled creation left to the next sync",
+			notion:  []*db.Event{notionEvent("u", "n")},
+			journal: []*db.JournalEntry{{UUID: "u", Origin: db.OriginNotion, Event: notionEvent("u", "n")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := findIssues(tt.notion, tt.google, tt.db, tt.journal)
+			got := []issue{}
+			for _, i := range issues {
+				got = append(got, issue{i.Kind, i.Fix, i.Side, i.ID})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("findIssues() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("issue %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFindIssuesRelinkMapping(t *testing.T) {
+	notionEvent := &db.Event{UUID: "u", NotionEventID: "n", Title: "title"}
+	googleCalendarEvent := &db.Event{UUID: "u", GoogleCalendarEventID: "g"}
+	issues := findIssues([]*db.Event{notionEvent}, []*db.Event{googleCalendarEvent}, nil, nil)
+	if len(issues) != 1 || issues[0].mapping == nil {
+		t.Fatalf("findIssues() = %v, want a relink", issues)
+	}
+	m := issues[0].mapping
+	if m.UUID != "u" || m.NotionEventID != "n" || m.GoogleCalendarEventID != "g" || m.Title != "title" {
+		t.Errorf("mapping = %+v, want the notion event linked to g", m)
+	}
+}
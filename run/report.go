@@ -0,0 +1,158 @@
+package run
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"golang.org/x/exp/slices"
+)
+
+// Outcomes of an event in a run
+const (
+	OutcomeCreated = "created"
+	OutcomeUpdated = "updated"
+	OutcomeDeleted = "deleted"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// Report describes what a run did
+type Report struct {
+	RunID     string         `json:"run_id"`
+	Trigger   string         `json:"trigger"`
+	StartedAt time.Time      `json:"started_at"`
+	EndedAt   time.Time      `json:"ended_at"`
+	Counts    map[string]int `json:"counts"` // Number of events by outcome and of failed events by class, of events listed on each side, and milliseconds waited for the Notion rate limiter
+	Events    []*EventResult `json:"events"` // Events that were not left unchanged
+	Conflicts []*db.Conflict `json:"conflicts"`
+	// DeadLetters are the events moved to the dead letters by the run
+	DeadLetters []*db.FailedEvent `json:"dead_letters"`
+	Steps       []*StepTiming     `json:"steps"`
+	Error       string            `json:"error,omitempty"`
+
+	mu sync.Mutex
+}
+
+// EventResult is the outcome of an event in a run
+type EventResult struct {
+	UUID    string `json:"uuid"`
+	Title   string `json:"title"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"` // Why the event was skipped or failed
+	Class   string `json:"class,omitempty"`  // Class of the error of a failed event, see retry.Class
+}
+
+// StepTiming is the duration of a step of a run
+type StepTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+func newReport(trigger string) *Report {
+	return &Report{
+		Trigger:     trigger,
+		StartedAt:   time.Now(),
+		Counts:      map[string]int{},
+		Events:      []*EventResult{},
+		Conflicts:   []*db.Conflict{},
+		DeadLetters: []*db.FailedEvent{},
+		Steps:       []*StepTiming{},
+	}
+}
+
+// The methods below do nothing on a nil report, so that the commands other than sync need none
+
+func (r *Report) event(event *db.Event, outcome string, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Counts[outcome]++
+	r.Events = append(r.Events, &EventResult{UUID: event.UUID, Title: event.Title, Outcome: outcome, Reason: reason})
+}
+
+func (r *Report) fail(event *db.Event, err error) {
+	if r == nil {
+		return
+	}
+	class := retry.Class(err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Counts[OutcomeFailed]++
+	r.Counts[OutcomeFailed+"_"+class]++
+	r.Events = append(r.Events, &EventResult{UUID: event.UUID, Title: event.Title, Outcome: OutcomeFailed, Reason: err.Error(), Class: class})
+}
+
+func (r *Report) count(key string, n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Counts[key] += n
+}
+
+func (r *Report) conflict(conflict *db.Conflict) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Conflicts = append(r.Conflicts, conflict)
+}
+
+func (r *Report) deadLetter(failed *db.FailedEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DeadLetters = append(r.DeadLetters, failed)
+}
+
+func (r *Report) step(name string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Steps = append(r.Steps, &StepTiming{Name: name, Seconds: duration.Seconds()})
+}
+
+// end completes the report once the run is over
+func (r *Report) end(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EndedAt = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	// Workers report events in any order
+	slices.SortStableFunc(r.Events, func(a, b *EventResult) int {
+		if a.Outcome != b.Outcome {
+			return slices.Index(outcomes, a.Outcome) - slices.Index(outcomes, b.Outcome)
+		}
+		if a.Title < b.Title {
+			return -1
+		}
+		if a.Title > b.Title {
+			return 1
+		}
+		return 0
+	})
+}
+
+var outcomes = []string{OutcomeFailed, OutcomeSkipped, OutcomeCreated, OutcomeUpdated, OutcomeDeleted}
+
+// reportResult reports the outcome of an event, or its failure if err is not nil
+func (s *services) reportResult(event *db.Event, outcome string, err error) {
+	if err != nil {
+		s.report.fail(event, err)
+		s.failures.add(event, err)
+		return
+	}
+	s.report.event(event, outcome, "")
+}
@@ -0,0 +1,165 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/googlecalendar"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/notioncalendar"
+	"golang.org/x/exp/slog"
+)
+
+// bury keeps the last known state of an event deleted on one side as a tombstone
+func (s *services) bury(ctx context.Context, event *db.Event, deletedOn string) error {
+	now := time.Now()
+	tombstone := &db.Tombstone{
+		UUID:      event.UUID,
+		Event:     event,
+		DeletedOn: deletedOn,
+		DeletedAt: now,
+		ExpiresAt: now.Add(s.config.TombstoneRetention),
+	}
+	return s.database.BuryEvent(ctx, tombstone)
+}
+
+// ListTombstones returns the deleted events that can be restored, most recently deleted first
+func ListTombstones() ([]*db.Tombstone, error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	tombstones, err := s.database.ListTombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Expired tombstones are purged by the next run
+	now := time.Now()
+	restorable := []*db.Tombstone{}
+	for _, tombstone := range tombstones {
+		if tombstone.ExpiresAt.After(now) {
+			restorable = append(restorable, tombstone)
+		}
+	}
+	return restorable, nil
+}
+
+// Restore recreates a deleted event on both sides from its tombstone
+func Restore(uuid string) (_ *db.Event, err error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	ctx, err = s.beginRun(ctx, "restore", db.TriggerCLI)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.endRun(ctx, err) }()
+
+	tombstone, err := s.database.GetTombstone(ctx, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("get tombstone of %s: %w", uuid, err)
+	}
+	if !tombstone.ExpiresAt.After(time.Now()) { // The deleted events may be gone from the trash
+		return nil, fmt.Errorf("tombstone of %s expired at %s", uuid, tombstone.ExpiresAt.Format(time.RFC3339))
+	}
+	// An interrupted restore is finished by the next run, which leaves the tombstone behind
+	_, err = s.database.GetEvent(ctx, uuid)
+	if err == nil {
+		err = s.database.DeleteTombstone(ctx, uuid)
+		if err != nil {
+			return nil, fmt.Errorf("delete tombstone of restored event: %w", err)
+		}
+		return nil, fmt.Errorf("event %s is already restored", uuid)
+	}
+	if !errors.Is(err, db.ErrEventNotFound) {
+		return nil, fmt.Errorf("get event %s: %w", uuid, err)
+	}
+	event := tombstone.Event
+	if err := s.restore(ctx, event); err != nil {
+		return nil, err
+	}
+	err = s.database.DeleteTombstone(ctx, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("delete restored tombstone: %w", err)
+	}
+	return event, nil
+}
+
+// restore recreates an event on both sides, reusing the deleted events where possible, and records it in the database.
+// The restore is journaled as a creation from Google Calendar, so that the next run finishes it if it is interrupted,
+// or rolls it back if the Google Calendar event could not be restored.
+func (s *services) restore(ctx context.Context, event *db.Event) error {
+	// The Notion page is created again by the next run until it is restored, since an archived page cannot be updated
+	entry := &db.JournalEntry{UUID: event.UUID, Origin: db.OriginGoogleCalendar, Event: cloneEvent(event), CreatedAt: time.Now()}
+	entry.Event.NotionEventID = ""
+	err := s.database.SetJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("record restore in journal: %w", err)
+	}
+
+	err = s.restoreGoogle(ctx, event)
+	s.record(ctx, db.OriginGoogleCalendar, db.ActionRestore, nil, event, err)
+	if err != nil {
+		return fmt.Errorf("restore google calendar event: %w", err)
+	}
+	entry.Event.GoogleCalendarEventID = event.GoogleCalendarEventID
+	err = s.database.SetJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("record restored google calendar event in journal: %w", err)
+	}
+
+	err = s.restoreNotion(ctx, event)
+	s.record(ctx, db.OriginNotion, db.ActionRestore, nil, event, err)
+	if err != nil {
+		return fmt.Errorf("restore notion event: %w", err)
+	}
+	entry.Event.NotionEventID = event.NotionEventID
+	err = s.database.SetJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("record restored notion event in journal: %w", err)
+	}
+
+	event.Version = 0 // Recorded again after it was buried
+	err = s.database.SetEvent(ctx, event)
+	s.record(ctx, db.SideDB, db.ActionRestore, nil, event, err)
+	if err != nil {
+		return fmt.Errorf("record restored event in db: %w", err)
+	}
+	err = s.database.DeleteJournalEntry(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("delete completed journal entry: %w", err)
+	}
+	return nil
+}
+
+// restoreGoogle brings back a deleted Google Calendar event, or inserts it again if it is gone
+func (s *services) restoreGoogle(ctx context.Context, event *db.Event) error {
+	// Google Calendar keeps deleted events, which an update brings back
+	err := s.google.UpdateEvent(ctx, event)
+	if googlecalendar.IsNotFound(err) {
+		slog.Info("insert google calendar event to restore", "uuid", event.UUID)
+		event.GoogleCalendarEventID, err = s.google.InsertEvent(ctx, event)
+	}
+	return err
+}
+
+// restoreNotion brings back an archived Notion page, or creates it again if it is gone
+func (s *services) restoreNotion(ctx context.Context, event *db.Event) error {
+	// Archived pages stay in the trash of Notion for a while
+	err := s.notion.RestoreEvent(ctx, event)
+	if notioncalendar.IsNotFound(err) {
+		slog.Info("create notion event to restore", "uuid", event.UUID)
+		event.NotionEventID, err = s.notion.CreateEvent(ctx, event)
+	}
+	return err
+}
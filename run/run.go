@@ -2,70 +2,165 @@ package run
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
-	"github.com/Kitsuya0828/notion-google-calendar-sync/googlecalendar"
-	"github.com/Kitsuya0828/notion-google-calendar-sync/notioncalendar"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/telemetry"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/slog"
 )
 
-func Run() error {
-	ctx := context.Background()
+// Options changes the behavior of a run
+type Options struct {
+	// AllowMassDeletion lets the run proceed even if it deletes more events than the configured limits
+	AllowMassDeletion bool
+	// Trigger is recorded in the audit log (db.TriggerScheduler, db.TriggerWebhook or db.TriggerCLI)
+	Trigger string
+}
+
+// Run synchronizes Notion and Google Calendar once and reports what it did, even if it fails.
+// The spans of the run are children of the span in ctx, if any.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	report := newReport(opts.Trigger)
+	err := run(ctx, opts, report)
+	report.end(err)
+	return report, err
+}
 
-	// List future events in Notion database
-	slog.Debug("list notion events")
-	notionCalendarService, err := notioncalendar.NewService()
+func run(ctx context.Context, opts Options, report *Report) (err error) {
+	ctx, span := telemetry.Start(ctx, "run", attribute.String("trigger", opts.Trigger))
+	defer func() { telemetry.End(span, err) }()
+
+	s, err := newServices(ctx)
 	if err != nil {
-		return fmt.Errorf("initialize notion calendar service: %v", err)
+		return err
 	}
-	notionEvents, err := notionCalendarService.ListEvents(ctx)
+	defer s.Close()
+	ctx, err = s.beginRun(ctx, "sync", opts.Trigger)
 	if err != nil {
-		return fmt.Errorf("list notion events: %v", err)
+		return err
+	}
+	defer func() { s.endRun(ctx, err) }()
+	s.report = report
+	s.failures = newFailures()
+	defer func() { s.notify(ctx, err) }()
+	report.RunID = s.audit.record.ID
+	report.Trigger = s.audit.record.Trigger
+	span.SetAttributes(attribute.String("run_id", report.RunID))
+	if opts.AllowMassDeletion {
+		s.config.AllowMassDeletion = true
 	}
-	// List future events in Google Calendar
-	slog.Debug("list google calendar events")
-	googleCalendarService, err := googlecalendar.NewService(ctx)
+
+	// List future events in Notion database and Google Calendar
+	var notionEvents, googleCalendarEvents []*db.Event
+	var invalid []*db.ValidationError
+	err = s.step(ctx, "list events", func(ctx context.Context) error {
+		notionEvents, googleCalendarEvents, invalid, err = s.listEvents(ctx)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("initialize google calendar service: %v", err)
+		return err
 	}
-	googleCalendarEvents, err := googleCalendarService.ListEvents()
+	report.count("notion_listed", len(notionEvents))
+	report.count("google_calendar_listed", len(googleCalendarEvents))
+
+	// Events failing repeatedly are left out until they are retried from the CLI
+	deadLetters, err := s.database.ListDeadLetters(ctx)
 	if err != nil {
-		return fmt.Errorf("list google calendar events: %v", err)
+		return fmt.Errorf("list dead letters: %w", err)
+	}
+	report.count("dead_letters", len(deadLetters))
+	dead := newHeld(deadLetters, nil)
+
+	// Events that cannot be read are left untouched, and the other events are synchronized
+	errs := []error{}
+	for _, v := range invalid {
+		if dead.has(v.Event()) {
+			continue
+		}
+		s.reportResult(v.Event(), OutcomeFailed, v)
+		errs = append(errs, v)
+	}
+	skip := newHeld(deadLetters, invalid)
+
+	// Finish or roll back creations interrupted in earlier runs
+	slog.Debug("replay journal")
+	var journaled map[string]bool
+	err = s.step(ctx, "replay journal", func(ctx context.Context) error {
+		journaled, err = s.replayJournal(ctx, notionEvents, googleCalendarEvents, skip)
+		return err
+	})
+	if err != nil { // Failed entries are left in the journal, and their events are skipped below
+		slog.Error("replay journal", "error", err)
+		errs = append(errs, fmt.Errorf("replay journal: %w", err))
+	}
+
+	// Check if new events have been added.
+	// Without the journal, interrupted creations would be created again, so new events wait for the next run.
+	if journaled == nil {
+		slog.Warn("skip check for added events: journal not read")
+	} else {
+		slog.Debug("check for added events")
+		err = s.step(ctx, "check for added events", func(ctx context.Context) error {
+			return s.checkAdd(ctx, notionEvents, googleCalendarEvents, journaled, skip)
+		})
+		if err != nil { // Failed creations are journaled and finished by the next run
+			slog.Error("check for added events", "error", err)
+			errs = append(errs, fmt.Errorf("check for added events: %w", err))
+		}
 	}
 
-	// Initialize Firestore client
-	slog.Debug("initialize firestore client")
-	databaseService, err := db.CreateService(ctx)
+	// List future events again
+	slog.Debug("list events again")
+	err = s.step(ctx, "list events again", func(ctx context.Context) error {
+		notionEvents, googleCalendarEvents, invalid, err = s.listEvents(ctx)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("initialize database service: %v", err)
+		return errors.Join(append(errs, fmt.Errorf("list events again: %w", err))...)
 	}
-	defer databaseService.Close()
 
-	// Check if new events have been added
-	slog.Debug("check for added events")
-	err = checkAdd(ctx, notionCalendarService, googleCalendarService, notionEvents, googleCalendarEvents, databaseService)
+	// Check if events have been updated or deleted
+	err = s.step(ctx, "check for updated or deleted events", func(ctx context.Context) error {
+		return s.checkUpdate(ctx, notionEvents, googleCalendarEvents, newHeld(deadLetters, invalid))
+	})
 	if err != nil {
-		return fmt.Errorf("check for added events: %v", err)
+		errs = append(errs, fmt.Errorf("check for updated or deleted events: %w", err))
 	}
 
-	// List future events again
-	slog.Debug("list notion events again")
-	notionEvents, err = notionCalendarService.ListEvents(ctx)
+	// Forget deleted events that can no longer be restored
+	err = s.step(ctx, "purge expired tombstones", func(ctx context.Context) error {
+		return s.database.PurgeTombstones(ctx, time.Now())
+	})
 	if err != nil {
-		return fmt.Errorf("list notion events again: %v", err)
+		errs = append(errs, fmt.Errorf("purge expired tombstones: %w", err))
 	}
-	slog.Debug("list google calendar events again")
-	googleCalendarEvents, err = googleCalendarService.ListEvents()
+
+	// Forget runs that can no longer be undone
+	err = s.step(ctx, "purge expired audit log", func(ctx context.Context) error {
+		return s.database.PurgeAudit(ctx, time.Now())
+	})
 	if err != nil {
-		return fmt.Errorf("list google calendar events again: %v", err)
+		errs = append(errs, fmt.Errorf("purge expired audit log: %w", err))
 	}
 
-	// Check if events have been updated or deleted
-	err = checkUpdate(ctx, notionCalendarService, googleCalendarService, notionEvents, googleCalendarEvents, databaseService)
+	// Count the failures of events, and leave out those failing repeatedly
+	err = s.step(ctx, "track failures", s.trackFailures)
 	if err != nil {
-		return fmt.Errorf("check for updated or deleted events: %v", err)
+		errs = append(errs, fmt.Errorf("track failures: %w", err))
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// step runs a step of a run in its own span and reports its duration
+func (s *services) step(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, span := telemetry.Start(ctx, name)
+	start := time.Now()
+	err := fn(ctx)
+	s.report.step(name, time.Since(start))
+	telemetry.End(span, err)
+	return err
 }
@@ -0,0 +1,136 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/googlecalendar"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/notify"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/notioncalendar"
+	"github.com/Kitsuya0828/notion-google-calendar-sync/retry"
+	"github.com/caarlos0/env/v9"
+	"golang.org/x/exp/slog"
+)
+
+type Config struct {
+	// Workers is the number of events processed concurrently
+	Workers int `env:"SYNC_WORKERS" envDefault:"8"`
+	// NotionConcurrency and GoogleConcurrency limit the concurrent calls to each provider
+	NotionConcurrency int `env:"SYNC_NOTION_CONCURRENCY" envDefault:"3"`
+	GoogleConcurrency int `env:"SYNC_GOOGLE_CONCURRENCY" envDefault:"5"`
+	// A run is aborted when it would delete more than MaxDeletions events or MaxDeletionPercent of the tracked events.
+	// Zero disables the limit.
+	MaxDeletions       int     `env:"SYNC_MAX_DELETIONS" envDefault:"10"`
+	MaxDeletionPercent float64 `env:"SYNC_MAX_DELETION_PERCENT" envDefault:"50"`
+	AllowMassDeletion  bool    `env:"SYNC_ALLOW_MASS_DELETION"`
+	// TombstoneRetention is how long deleted events can be restored
+	TombstoneRetention time.Duration `env:"SYNC_TOMBSTONE_RETENTION" envDefault:"720h"`
+	// AuditRetention is how long runs and their operations are kept in the audit log, and can be undone
+	AuditRetention time.Duration `env:"SYNC_AUDIT_RETENTION" envDefault:"720h"`
+	// ConflictPolicy resolves fields changed differently on both sides, and ConflictFieldPolicies overrides it per field
+	ConflictPolicy        string            `env:"SYNC_CONFLICT_POLICY" envDefault:"newest-wins"`
+	ConflictFieldPolicies map[string]string `env:"SYNC_CONFLICT_FIELD_POLICIES"`
+	// DeadLetterAfter is the number of runs in a row an event may fail before it is left out. Zero disables the limit.
+	DeadLetterAfter int `env:"SYNC_DEAD_LETTER_AFTER" envDefault:"3"`
+	// MaxSyncAge is how long the health probes of the daemon tolerate no successful sync
+	MaxSyncAge time.Duration `env:"HEALTH_MAX_SYNC_AGE" envDefault:"90m"`
+	// LockTTL is how long the run lock is held without being renewed, for example after a crash
+	LockTTL time.Duration `env:"SYNC_LOCK_TTL" envDefault:"2m"`
+}
+
+// services holds the clients shared by the steps of a run
+type services struct {
+	config   Config
+	exec     *executor
+	notion   *notioncalendar.CalendarService
+	google   *googlecalendar.CalendarService
+	database *db.DatabaseService
+	audit    *audit // Nil if operations are not recorded
+	metrics  *metrics
+	report   *Report   // Nil if the run is not reported
+	failures *failures // Nil if failures are not tracked
+	notifier *notify.Dispatcher
+	runLock  *runLock // Nil if no run is in progress
+}
+
+func newServices(ctx context.Context) (*services, error) {
+	cfg := Config{}
+	if err := env.Parse(&cfg); err != nil {
+		return nil, fmt.Errorf("parse env: %w", err)
+	}
+	if cfg.Workers < 1 || cfg.NotionConcurrency < 1 || cfg.GoogleConcurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1")
+	}
+	if err := validatePolicies(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.LockTTL <= 0 {
+		return nil, fmt.Errorf("lock ttl must be positive")
+	}
+	if cfg.AuditRetention <= 0 {
+		return nil, fmt.Errorf("audit retention must be positive")
+	}
+
+	metrics, err := newMetrics()
+	if err != nil {
+		return nil, fmt.Errorf("initialize metrics: %w", err)
+	}
+
+	// Share the retry budget between both APIs
+	retrier, err := retry.NewRetrier()
+	if err != nil {
+		return nil, fmt.Errorf("initialize retrier: %w", err)
+	}
+	notionCalendarService, err := notioncalendar.NewService(retrier)
+	if err != nil {
+		return nil, fmt.Errorf("initialize notion calendar service: %w", err)
+	}
+	googleCalendarService, err := googlecalendar.NewService(ctx, retrier)
+	if err != nil {
+		return nil, fmt.Errorf("initialize google calendar service: %w", err)
+	}
+
+	// Initialize Firestore client
+	slog.Debug("initialize firestore client")
+	databaseService, err := db.CreateService(ctx, notionCalendarService.Location())
+	if err != nil {
+		return nil, fmt.Errorf("initialize database service: %w", err)
+	}
+
+	notifier, err := notify.NewDispatcher(databaseService)
+	if err != nil {
+		return nil, fmt.Errorf("initialize notifier: %w", err)
+	}
+
+	s := &services{
+		config:   cfg,
+		exec:     newExecutor(cfg),
+		notion:   notionCalendarService,
+		google:   googleCalendarService,
+		database: databaseService,
+		metrics:  metrics,
+		notifier: notifier,
+	}
+	return s, nil
+}
+
+// listEvents lists future events on both sides, and the events that cannot be read, which are left out
+func (s *services) listEvents(ctx context.Context) ([]*db.Event, []*db.Event, []*db.ValidationError, error) {
+	slog.Debug("list notion events")
+	notionEvents, invalidNotion, err := s.notion.ListEvents(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("list notion events: %w", err)
+	}
+	slog.Debug("list google calendar events")
+	googleCalendarEvents, invalidGoogle, err := s.google.ListEvents(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("list google calendar events: %w", err)
+	}
+	return notionEvents, googleCalendarEvents, append(invalidNotion, invalidGoogle...), nil
+}
+
+func (s *services) Close() error {
+	return s.database.Close()
+}
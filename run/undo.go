@@ -0,0 +1,223 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slog"
+)
+
+// linkFields are the identifiers of an event, which are reverted along with its fields
+var linkFields = []field{
+	{
+		name:   "uuid",
+		equal:  func(a, b *db.Event) bool { return a.UUID == b.UUID },
+		copy:   func(dst, src *db.Event) { dst.UUID = src.UUID },
+		format: func(e *db.Event) string { return e.UUID },
+	},
+	{
+		name:   "notion_event_id",
+		equal:  func(a, b *db.Event) bool { return a.NotionEventID == b.NotionEventID },
+		copy:   func(dst, src *db.Event) { dst.NotionEventID = src.NotionEventID },
+		format: func(e *db.Event) string { return e.NotionEventID },
+	},
+	{
+		name:   "google_calendar_event_id",
+		equal:  func(a, b *db.Event) bool { return a.GoogleCalendarEventID == b.GoogleCalendarEventID },
+		copy:   func(dst, src *db.Event) { dst.GoogleCalendarEventID = src.GoogleCalendarEventID },
+		format: func(e *db.Event) string { return e.GoogleCalendarEventID },
+	},
+}
+
+// Reversal is the result of reverting an operation
+type Reversal struct {
+	Operation *db.Operation
+	Reverted  []string // Fields set back to their value before the operation
+	Kept      []string // Fields edited again since the operation, which are left as they are
+	Skipped   string   // Why the operation was not reverted, if it was not
+	Err       error
+}
+
+// Undo reverts the operations of a run on Notion, Google Calendar and the database, latest first.
+// Fields edited again since the run are not reverted, nor are events created by the run and edited since.
+func Undo(runID string) (_ []*Reversal, err error) {
+	ctx := context.Background()
+
+	s, err := newServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if _, err := s.database.GetRunRecord(ctx, runID); err != nil {
+		return nil, err
+	}
+	// The current state is read under the run lock, so that no sync changes it meanwhile
+	ctx, err = s.beginRun(ctx, "undo", db.TriggerCLI)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.endRun(ctx, err) }()
+
+	operations, err := s.database.ListOperations(ctx, "run_id", runID)
+	if err != nil {
+		return nil, err
+	}
+
+	notionEvents, googleCalendarEvents, invalid, err := s.listEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 { // Events that cannot be read would be taken for missing ones
+		return nil, fmt.Errorf("fix the events that cannot be read first: %w", joinInvalid(invalid))
+	}
+	dbEvents, err := s.database.ListEvents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list db events: %w", err)
+	}
+	current := map[string]map[string]*db.Event{
+		db.OriginNotion:         getEventsIDMap(notionEvents),
+		db.OriginGoogleCalendar: getEventsIDMap(googleCalendarEvents),
+		db.SideDB:               getEventsIDMap(dbEvents),
+	}
+
+	reversals := []*Reversal{}
+	errs := []error{}
+	for i := len(operations) - 1; i >= 0; i-- {
+		r := &Reversal{Operation: operations[i]}
+		s.revert(ctx, r, current[r.Operation.Side])
+		if r.Err != nil {
+			slog.Error("revert operation", "uuid", r.Operation.UUID, "side", r.Operation.Side, "action", r.Operation.Action, "error", r.Err)
+			errs = append(errs, fmt.Errorf("revert %s of %s on %s: %w", r.Operation.Action, r.Operation.UUID, r.Operation.Side, r.Err))
+		}
+		reversals = append(reversals, r)
+	}
+	return reversals, errors.Join(errs...)
+}
+
+// revert reverts an operation given the current events on its side by UUID, which are updated with the result
+func (s *services) revert(ctx context.Context, r *Reversal, events map[string]*db.Event) {
+	event, exists := events[r.Operation.UUID]
+	before, after, ok := r.plan(event, exists)
+	if !ok {
+		return
+	}
+	r.Err = s.revertTo(ctx, r.Operation.Side, before, after)
+	if r.Err == nil {
+		delete(events, r.Operation.UUID)
+		if after != nil {
+			events[after.UUID] = after
+		}
+	}
+}
+
+// plan decides how to revert the operation of r given the current event on its side, if it exists.
+// It returns the event to change from before to after, or false with the reason in r if the operation is skipped.
+func (r *Reversal) plan(event *db.Event, exists bool) (before *db.Event, after *db.Event, ok bool) {
+	op := r.Operation
+	if op.Error != "" {
+		r.Skipped = "failed in the run"
+		return nil, nil, false
+	}
+	if exists && event.TimeZone == "" && op.After != nil {
+		// A side without a time zone keeps the one it was written with, as in mergeEvent
+		event = cloneEvent(event)
+		event.TimeZone = op.After.TimeZone
+	}
+
+	switch op.Action {
+	case db.ActionCreate, db.ActionRestore:
+		if !exists {
+			r.Skipped = "deleted since"
+			return nil, nil, false
+		}
+		if !equalEvents(event, op.After) {
+			r.Skipped = "edited since"
+			return nil, nil, false
+		}
+		return event, nil, true
+	case db.ActionDelete:
+		if exists {
+			r.Skipped = "created again since"
+			return nil, nil, false
+		}
+		return nil, cloneEvent(op.Before), true
+	case db.ActionUpdate:
+		if !exists {
+			r.Skipped = "deleted since"
+			return nil, nil, false
+		}
+		target := cloneEvent(event)
+		for _, f := range append(eventFields(op.Before, op.After, event), linkFields...) {
+			if f.equal(op.Before, op.After) { // Not changed by the operation
+				continue
+			}
+			if !f.equal(event, op.After) {
+				r.Kept = append(r.Kept, f.name)
+				continue
+			}
+			f.copy(target, op.Before)
+			r.Reverted = append(r.Reverted, f.name)
+		}
+		if len(r.Reverted) == 0 {
+			r.Skipped = "edited since"
+			return nil, nil, false
+		}
+		return event, target, true
+	default:
+		r.Skipped = fmt.Sprintf("unknown action %q", op.Action)
+		return nil, nil, false
+	}
+}
+
+// revertTo changes an event on a side from before to after, creating it if before is nil or deleting it if after is nil
+func (s *services) revertTo(ctx context.Context, side string, before *db.Event, after *db.Event) error {
+	var err error
+	var action string
+	switch {
+	case after == nil:
+		action = db.ActionDelete
+		switch side {
+		case db.OriginNotion:
+			err = s.notion.DeleteEvent(ctx, before)
+		case db.OriginGoogleCalendar:
+			err = s.google.DeleteEvent(ctx, before)
+		case db.SideDB:
+			err = s.database.DeleteEvent(ctx, before)
+		}
+	case before == nil:
+		action = db.ActionRestore
+		switch side {
+		case db.OriginNotion:
+			err = s.restoreNotion(ctx, after)
+		case db.OriginGoogleCalendar:
+			err = s.restoreGoogle(ctx, after)
+		case db.SideDB:
+			after.Version = 0 // Recorded again after it was deleted
+			err = s.database.SetEvent(ctx, after)
+			if err == nil {
+				err = s.database.DeleteTombstone(ctx, after.UUID)
+			}
+		}
+	default:
+		action = db.ActionUpdate
+		switch side {
+		case db.OriginNotion:
+			err = s.notion.UpdateEvent(ctx, after)
+		case db.OriginGoogleCalendar:
+			err = s.google.UpdateEvent(ctx, after)
+		case db.SideDB:
+			if after.UUID != before.UUID { // Recorded under the previous UUID again
+				after.Version = 0
+			}
+			err = s.database.SetEvent(ctx, after)
+			if err == nil && after.UUID != before.UUID {
+				err = s.database.DeleteEvent(ctx, before)
+			}
+		}
+	}
+	s.record(ctx, side, action, before, after, err)
+	return err
+}
@@ -0,0 +1,128 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slices"
+)
+
+func TestReversalPlan(t *testing.T) {
+	start := time.Date(2023, 10, 1, 10, 0, 0, 0, time.UTC)
+	event := func(title string, timeZone string) *db.Event {
+		return &db.Event{
+			UUID:      "uuid",
+			Title:     title,
+			StartTime: start,
+			EndTime:   start.Add(time.Hour),
+			TimeZone:  timeZone,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		op       *db.Operation
+		event    *db.Event // Current event on the side, nil if missing
+		ok       bool
+		skipped  string
+		reverted []string
+		kept     []string
+	}{
+		{
+			// Notion pages do not keep the time zone of an event
+			name:  "create on notion without time zone",
+			op:    &db.Operation{Side: db.OriginNotion, Action: db.ActionCreate, After: event("a", "Asia/Tokyo")},
+			event: event("a", ""),
+			ok:    true,
+		},
+		{
+			name:    "create edited since",
+			op:      &db.Operation{Side: db.OriginNotion, Action: db.ActionCreate, After: event("a", "Asia/Tokyo")},
+			event:   event("b", ""),
+			skipped: "edited since",
+		},
+		{
+			name:    "create deleted since",
+			op:      &db.Operation{Side: db.OriginGoogleCalendar, Action: db.ActionCreate, After: event("a", "Asia/Tokyo")},
+			skipped: "deleted since",
+		},
+		{
+			name:     "update on notion without time zone",
+			op:       &db.Operation{Side: db.OriginNotion, Action: db.ActionUpdate, Before: event("a", "Asia/Tokyo"), After: event("b", "Asia/Tokyo")},
+			event:    event("b", ""),
+			ok:       true,
+			reverted: []string{"title"},
+		},
+		{
+			name:     "update of the time zone on notion",
+			op:       &db.Operation{Side: db.OriginNotion, Action: db.ActionUpdate, Before: event("a", "UTC"), After: event("a", "Asia/Tokyo")},
+			event:    event("a", ""),
+			ok:       true,
+			reverted: []string{"time"},
+		},
+		{
+			name:     "update partly edited since",
+			op:       &db.Operation{Side: db.OriginGoogleCalendar, Action: db.ActionUpdate, Before: event("a", "UTC"), After: event("b", "Asia/Tokyo")},
+			event:    event("c", "Asia/Tokyo"),
+			ok:       true,
+			reverted: []string{"time"},
+			kept:     []string{"title"},
+		},
+		{
+			name:    "update edited since",
+			op:      &db.Operation{Side: db.OriginGoogleCalendar, Action: db.ActionUpdate, Before: event("a", "UTC"), After: event("b", "UTC")},
+			event:   event("c", "UTC"),
+			skipped: "edited since",
+			kept:    []string{"title"},
+		},
+		{
+			name:  "delete",
+			op:    &db.Operation{Side: db.SideDB, Action: db.ActionDelete, Before: event("a", "UTC")},
+			ok:    true,
+			event: nil,
+		},
+		{
+			name:    "delete created again since",
+			op:      &db.Operation{Side: db.SideDB, Action: db.ActionDelete, Before: event("a", "UTC")},
+			event:   event("a", "UTC"),
+			skipped: "created again since",
+		},
+		{
+			name:    "failed",
+			op:      &db.Operation{Side: db.SideDB, Action: db.ActionDelete, Before: event("a", "UTC"), Error: "failed"},
+			skipped: "failed in the run",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Reversal{Operation: tt.op}
+			before, after, ok := r.plan(tt.event, tt.event != nil)
+			if ok != tt.ok || r.Skipped != tt.skipped {
+				t.Fatalf("plan() = %v, skipped %q, want %v, skipped %q", ok, r.Skipped, tt.ok, tt.skipped)
+			}
+			if !slices.Equal(r.Reverted, tt.reverted) || !slices.Equal(r.Kept, tt.kept) {
+				t.Errorf("reverted %v, kept %v, want %v, %v", r.Reverted, r.Kept, tt.reverted, tt.kept)
+			}
+			if !ok {
+				return
+			}
+			switch tt.op.Action {
+			case db.ActionCreate:
+				if before == nil || after != nil {
+					t.Errorf("plan() = %v, %v, want a deletion", before, after)
+				}
+			case db.ActionDelete:
+				if before != nil || after == nil || !equalEvents(after, tt.op.Before) {
+					t.Errorf("plan() = %v, %v, want a restore of %v", before, after, tt.op.Before)
+				}
+			case db.ActionUpdate:
+				for _, f := range fields {
+					if slices.Contains(tt.reverted, f.name) && !f.equal(after, tt.op.Before) {
+						t.Errorf("%s = %q, want %q", f.name, f.format(after), f.format(tt.op.Before))
+					}
+				}
+			}
+		})
+	}
+}
@@ -2,9 +2,6 @@ package run
 
 import (
 	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
-	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
-	"golang.org/x/exp/slog"
 )
 
 func getEventsIDMap(events []*db.Event) map[string]*db.Event {
@@ -19,53 +16,16 @@ func updateEventField(dbEvent *db.Event, partiallyUpdatedEvent *db.Event) *db.Ev
 	updatedEvent := dbEvent
 
 	updatedEvent.Title = partiallyUpdatedEvent.Title
-	if partiallyUpdatedEvent.NotionEventID != "" {
-		updatedEvent.Color = partiallyUpdatedEvent.Color
-	}
+	updatedEvent.Color = partiallyUpdatedEvent.Color
+	updatedEvent.Tags = partiallyUpdatedEvent.Tags
+	updatedEvent.Properties = partiallyUpdatedEvent.Properties
 	updatedEvent.StartTime = partiallyUpdatedEvent.StartTime
 	updatedEvent.EndTime = partiallyUpdatedEvent.EndTime
 	updatedEvent.IsAllday = partiallyUpdatedEvent.IsAllday
+	if partiallyUpdatedEvent.TimeZone != "" {
+		updatedEvent.TimeZone = partiallyUpdatedEvent.TimeZone
+	}
 	updatedEvent.Description = partiallyUpdatedEvent.Description
 
 	return dbEvent
 }
-
-func getCorrectEvent(dbEvent *db.Event, notionEvent *db.Event, googleCalendarEvent *db.Event) (*db.Event, bool, bool) {
-	correctEvent := dbEvent
-
-	notionOpts := []cmp.Option{
-		cmpopts.IgnoreFields(db.Event{}, "CreatedTime", "UpdatedTime", "NotionEventID", "GoogleCalendarEventID"),
-	}
-
-	isNotionUpdated := false
-	diff := cmp.Diff(dbEvent, notionEvent, notionOpts...)
-	if diff != "" {
-		isNotionUpdated = true
-		slog.Info("compare db event with notion event", diff)
-	}
-
-	googleCalendarOpts := []cmp.Option{
-		cmpopts.IgnoreFields(db.Event{}, "Color", "CreatedTime", "UpdatedTime", "NotionEventID", "GoogleCalendarEventID"),
-	}
-
-	isGoogleCalendarUpdated := false
-	diff = cmp.Diff(dbEvent, googleCalendarEvent, googleCalendarOpts...)
-	if diff != "" {
-		isGoogleCalendarUpdated = true
-		slog.Info("compare db event with google calendar event", diff)
-	}
-
-	if isNotionUpdated && !isGoogleCalendarUpdated {
-		correctEvent = updateEventField(dbEvent, notionEvent)
-	} else if !isNotionUpdated && isGoogleCalendarUpdated {
-		correctEvent = updateEventField(dbEvent, googleCalendarEvent)
-	} else if isNotionUpdated && isGoogleCalendarUpdated {
-		if notionEvent.UpdatedTime.After(googleCalendarEvent.UpdatedTime) {
-			correctEvent = updateEventField(dbEvent, notionEvent)
-		} else {
-			correctEvent = updateEventField(dbEvent, googleCalendarEvent)
-		}
-	}
-
-	return correctEvent, isNotionUpdated, isGoogleCalendarUpdated
-}
@@ -0,0 +1,46 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Kitsuya0828/notion-google-calendar-sync/db"
+	"golang.org/x/exp/slog"
+)
+
+// setEvent writes an event changed from base to the database. If another writer has changed the event since it was read,
+// the fields changed from base are applied again to the event read again, keeping the mapping recorded by the other writer.
+func (s *services) setEvent(ctx context.Context, base *db.Event, event *db.Event) (*db.Event, error) {
+	err := s.database.SetEvent(ctx, event)
+	if !errors.Is(err, db.ErrEventChanged) {
+		return event, err
+	}
+	current, err := s.database.GetEvent(ctx, event.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("read changed event again: %w", err)
+	}
+	rebased := cloneEvent(current)
+	for _, f := range eventFields(base, event, current) {
+		if !f.equal(base, event) {
+			f.copy(rebased, event)
+		}
+	}
+	slog.Warn("apply changes to event changed by another writer", "uuid", event.UUID, "version", current.Version)
+	return rebased, s.database.SetEvent(ctx, rebased)
+}
+
+// adoptVersion sets the version of an event to the version recorded in the database, or zero if it is not recorded,
+// before a write meant to replace whatever the database has, such as the completion of an interrupted creation
+func (s *services) adoptVersion(ctx context.Context, event *db.Event) error {
+	current, err := s.database.GetEvent(ctx, event.UUID)
+	if errors.Is(err, db.ErrEventNotFound) {
+		event.Version = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	event.Version = current.Version
+	return nil
+}
@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// ScopeName is the instrumentation scope of the metrics and traces of this module
+const ScopeName = "github.com/Kitsuya0828/notion-google-calendar-sync"
+
+// Meter returns the meter of this module. Instruments created before SetupMetrics are bound once it is called.
+func Meter() metric.Meter {
+	return otel.Meter(ScopeName)
+}
+
+// SetupMetrics sets a global meter provider exporting the metrics to Prometheus,
+// and returns the handler of the scrape endpoint and a function flushing the metrics
+func SetupMetrics() (http.Handler, func(ctx context.Context) error, error) {
+	registry := prometheus.NewRegistry()
+	exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry), otelprometheus.WithNamespace("notion_google_calendar_sync"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("create prometheus exporter: %w", err)
+	}
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
+	otel.SetMeterProvider(provider)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), provider.Shutdown, nil
+}
+
+// API records the calls to the API of a provider
+type API struct {
+	provider string
+	duration metric.Float64Histogram
+	errors   metric.Int64Counter
+	listed   metric.Int64Counter
+}
+
+func NewAPI(provider string) (*API, error) {
+	meter := Meter()
+	duration, err := meter.Float64Histogram("api.call.duration",
+		metric.WithDescription("Latency of the API calls by endpoint, including failed attempts"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("create api call duration histogram: %w", err)
+	}
+	errors, err := meter.Int64Counter("api.call.errors",
+		metric.WithDescription("Number of failed API calls by endpoint"))
+	if err != nil {
+		return nil, fmt.Errorf("create api call error counter: %w", err)
+	}
+	listed, err := meter.Int64Counter("events.listed",
+		metric.WithDescription("Number of events listed by side"))
+	if err != nil {
+		return nil, fmt.Errorf("create listed event counter: %w", err)
+	}
+	api := &API{
+		provider: provider,
+		duration: duration,
+		errors:   errors,
+		listed:   listed,
+	}
+	return api, nil
+}
+
+// Observe records an attempt to call an endpoint that started at start
+func (a *API) Observe(ctx context.Context, endpoint string, start time.Time, err error) {
+	attrs := metric.WithAttributes(attribute.String("provider", a.provider), attribute.String("endpoint", endpoint))
+	a.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil {
+		a.errors.Add(ctx, 1, attrs)
+	}
+}
+
+// Listed records the number of events listed
+func (a *API) Listed(ctx context.Context, n int) {
+	a.listed.Add(ctx, int64(n), metric.WithAttributes(attribute.String("side", a.provider)))
+}
@@ -86,6 +86,11 @@ resource "google_cloudfunctions2_function" "default" {
       #   NOTION_TAGS_PROPERTY_NAME        = "XXXX"
       #   NOTION_DATE_PROPERTY_NAME        = "XXXX"
       #   NOTION_UUID_PROPERTY_NAME        = "XXXX"
+      #   NOTION_TAG_COLORS                = "XXXX"
+      #   NOTION_TAG_COLOR_PRECEDENCE      = "XXXX"
+      #   GOOGLE_STATUS_PROPERTY           = "XXXX"
+      #   GOOGLE_STATUS_MAP                = "XXXX"
+      #   NOTIFY_WEBHOOK_URL               = "XXXX"
     }
   }
 